@@ -0,0 +1,376 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+// correlationKey is an annotation or label key events are correlated by.
+type correlationKey struct {
+	source string
+	key    string
+}
+
+func (k correlationKey) String() string {
+	return k.source + ":" + k.key
+}
+
+// correlationKeys returns the configured keys, annotations first.
+func (o *Options) correlationKeys() []correlationKey {
+	var keys []correlationKey
+	for _, k := range o.CorrelationAnnotations {
+		keys = append(keys, correlationKey{source: SourceAnnotation, key: k})
+	}
+	for _, k := range o.CorrelationLabels {
+		keys = append(keys, correlationKey{source: SourceLabel, key: k})
+	}
+	return keys
+}
+
+// correlate appends the correlations of an object with the given metadata
+// to cs, skipping keys cs already holds.
+func correlate(cs []Correlation, keys []correlationKey, meta *metav1.ObjectMeta, from string) []Correlation {
+	if meta == nil {
+		return cs
+	}
+next:
+	for _, k := range keys {
+		for _, c := range cs {
+			if c.Source == k.source && c.Key == k.key {
+				continue next
+			}
+		}
+		values := meta.Annotations
+		if k.source == SourceLabel {
+			values = meta.Labels
+		}
+		if v, ok := values[k.key]; ok {
+			cs = append(cs, Correlation{Source: k.source, Key: k.key, Value: v, From: from})
+		}
+	}
+	return cs
+}
+
+// correlateItems returns the items of a list body that match a correlation
+// key.
+func correlateItems(keys []correlationKey, items []metav1.ObjectMeta, from string) []MatchedItem {
+	var matched []MatchedItem
+	for i := range items {
+		item := &items[i]
+		if cs := correlate(nil, keys, item, from); len(cs) > 0 {
+			matched = append(matched, MatchedItem{
+				Namespace:    item.Namespace,
+				Name:         item.Name,
+				UID:          item.UID,
+				Correlations: cs,
+			})
+		}
+	}
+	return matched
+}
+
+// mergeCorrelations appends the correlations of src to cs, skipping values cs
+// already holds. Unlike correlate, it keeps several values of the same key,
+// as the items of a list may belong to different commits.
+func mergeCorrelations(cs, src []Correlation) []Correlation {
+next:
+	for _, c := range src {
+		for _, d := range cs {
+			if c.Source == d.Source && c.Key == d.Key && c.Value == d.Value {
+				continue next
+			}
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// correlateEvent returns the event considered for storage for ev, with the
+// correlations found in its bodies, the response taking precedence over the
+// request, and the keys of the object it is about. Events with a list body
+// are correlated with every value found on its items.
+func (r *Receiver) correlateEvent(ev *v1beta1.Event) *ingestEvent {
+	rec := &Record{Event: *ev}
+	resp, err := readBody(ev.ResponseObject)
+	if err != nil {
+		glog.Warningf("Keeping response body of audit event %s as opaque bytes: %v", ev.AuditID, err)
+	}
+	req, err := readBody(ev.RequestObject)
+	if err != nil {
+		glog.Warningf("Keeping request body of audit event %s as opaque bytes: %v", ev.AuditID, err)
+	}
+	rec.Event.ResponseObject, rec.OpaqueResponseObject = resp.object, resp.opaque
+	rec.Event.RequestObject, rec.OpaqueRequestObject = req.object, req.opaque
+
+	rec.Correlations = correlate(rec.Correlations, r.keys, resp.meta, FromResponseObject)
+	rec.Correlations = correlate(rec.Correlations, r.keys, req.meta, FromRequestObject)
+	rec.Items = append(correlateItems(r.keys, resp.items, FromResponseObject), correlateItems(r.keys, req.items, FromRequestObject)...)
+	for _, item := range rec.Items {
+		rec.Correlations = mergeCorrelations(rec.Correlations, item.Correlations)
+	}
+	return &ingestEvent{
+		record:    rec,
+		uidKey:    eventUIDKey(ev, resp.meta, req.meta),
+		objectKey: eventObjectKey(ev, resp.meta, req.meta),
+		ownerKeys: ownerUIDKeys(resp.meta, req.meta),
+	}
+}
+
+// body is a request or response body prepared for storage.
+type body struct {
+	// object is the body in JSON, or nil if it is opaque.
+	object *runtime.Unknown
+	opaque *OpaqueObject
+	meta   *metav1.ObjectMeta
+	items  []metav1.ObjectMeta
+}
+
+// readBody converts obj to JSON and parses its metadata. Bodies that cannot be
+// decoded are returned as opaque, together with the error, so that a single
+// undecodable body never fails its batch. JSON bodies without object metadata
+// are kept as they are.
+func readBody(obj *runtime.Unknown) (body, error) {
+	converted, err := jsonBody(obj)
+	if err != nil {
+		opaqueBodies.Inc()
+		return body{opaque: opaqueObject(obj)}, err
+	}
+	meta, items, err := parseBody(converted)
+	if err != nil {
+		if json.Valid(converted.Raw) {
+			return body{object: converted}, nil
+		}
+		opaqueBodies.Inc()
+		return body{opaque: opaqueObject(obj)}, err
+	}
+	return body{object: converted, meta: meta, items: items}, nil
+}
+
+func opaqueObject(obj *runtime.Unknown) *OpaqueObject {
+	return &OpaqueObject{
+		ContentType:     obj.ContentType,
+		ContentEncoding: obj.ContentEncoding,
+		Raw:             obj.Raw,
+	}
+}
+
+// ownerUIDKeys returns the UID keys of the owners of the first body with
+// owner references, the controller first.
+func ownerUIDKeys(metas ...*metav1.ObjectMeta) [][]byte {
+	for _, meta := range metas {
+		if meta == nil || len(meta.OwnerReferences) == 0 {
+			continue
+		}
+		var keys [][]byte
+		for _, ref := range meta.OwnerReferences {
+			if ref.UID == "" {
+				continue
+			}
+			if ref.Controller != nil && *ref.Controller {
+				keys = append([][]byte{uidKey(ref.UID)}, keys...)
+			} else {
+				keys = append(keys, uidKey(ref.UID))
+			}
+		}
+		return keys
+	}
+	return nil
+}
+
+// eventUIDKey returns the UID key of the object ev is about, taken from the
+// ObjectRef or else the bodies.
+func eventUIDKey(ev *v1beta1.Event, metas ...*metav1.ObjectMeta) []byte {
+	if ev.ObjectRef == nil {
+		return nil
+	}
+	if ev.ObjectRef.UID != "" {
+		return uidKey(ev.ObjectRef.UID)
+	}
+	// the bodies of subresources, like Scale, carry the UID of their object,
+	// but bodies of other kinds, like Status, must not be mistaken for it
+	for _, meta := range metas {
+		if meta != nil && meta.UID != "" && (ev.ObjectRef.Name == "" || meta.Name == ev.ObjectRef.Name) {
+			return uidKey(meta.UID)
+		}
+	}
+	return nil
+}
+
+// eventObjectKey returns the object key of the object ev is about. The name
+// and namespace of created objects are missing from the ObjectRef, and are
+// taken from the bodies instead.
+func eventObjectKey(ev *v1beta1.Event, metas ...*metav1.ObjectMeta) []byte {
+	ref := ev.ObjectRef
+	if ref == nil || ref.Resource == "" {
+		return nil
+	}
+	name, namespace := ref.Name, ref.Namespace
+	for _, meta := range metas {
+		if meta == nil {
+			continue
+		}
+		if name == "" {
+			name = meta.Name
+		}
+		if namespace == "" {
+			namespace = meta.Namespace
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	return objectKey(ref.APIGroup, ref.Resource, namespace, name)
+}
+
+// bodyMeta returns the object metadata of an audit request or response body.
+func bodyMeta(obj *runtime.Unknown) (*metav1.ObjectMeta, error) {
+	meta, _, err := parseBody(obj)
+	return meta, err
+}
+
+// parseBody returns the object metadata of an audit request or response body,
+// and the metadata of its items if it is a list. JSON patches are reduced to
+// the annotations and labels they set, while merge and strategic merge patches
+// already have the shape of an object.
+func parseBody(obj *runtime.Unknown) (*metav1.ObjectMeta, []metav1.ObjectMeta, error) {
+	if obj == nil {
+		return nil, nil, nil
+	}
+	raw := bytes.TrimSpace(obj.Raw)
+	if len(raw) == 0 {
+		return nil, nil, nil
+	}
+	if raw[0] == '[' {
+		meta, err := jsonPatchMeta(raw)
+		return meta, nil, err
+	}
+
+	type Item struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
+		// Items holds the items of lists, like PodList.
+		Items json.RawMessage `json:"items,omitempty"`
+	}
+
+	item := &Item{}
+	if err := json.Unmarshal(raw, item); err != nil {
+		return nil, nil, err
+	}
+	if !isList(&item.ObjectMeta, item.Items) {
+		return &item.ObjectMeta, nil, nil
+	}
+	var listItems []struct {
+		metav1.ObjectMeta `json:"metadata,omitempty"`
+	}
+	if err := json.Unmarshal(item.Items, &listItems); err != nil {
+		return nil, nil, err
+	}
+	items := make([]metav1.ObjectMeta, 0, len(listItems))
+	for _, i := range listItems {
+		items = append(items, i.ObjectMeta)
+	}
+	// the metadata of a list is a ListMeta, which carries no annotations or
+	// labels
+	return &metav1.ObjectMeta{}, items, nil
+}
+
+// isList reports whether a body with the metadata meta and the items field
+// items is a list, like the PodList returned by list and deletecollection
+// requests on pods. Lists are told by their body rather than their kind, as
+// object kinds may end in List too: they have an items array, and their
+// metadata is a ListMeta, which carries no name, UID, annotations or labels.
+func isList(meta *metav1.ObjectMeta, items json.RawMessage) bool {
+	items = bytes.TrimSpace(items)
+	if len(items) == 0 || items[0] != '[' {
+		return false
+	}
+	return meta.Name == "" && meta.GenerateName == "" && meta.UID == "" &&
+		len(meta.Annotations) == 0 && len(meta.Labels) == 0
+}
+
+// isListBody reports whether a JSON body is a list, see isList.
+func isListBody(raw []byte) bool {
+	body := struct {
+		Metadata metav1.ObjectMeta `json:"metadata,omitempty"`
+		Items    json.RawMessage   `json:"items,omitempty"`
+	}{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return false
+	}
+	return isList(&body.Metadata, body.Items)
+}
+
+// jsonPatchMeta returns the annotations and labels added or replaced by a
+// JSON patch.
+func jsonPatchMeta(raw []byte) (*metav1.ObjectMeta, error) {
+	var ops []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(raw, &ops); err != nil {
+		return nil, err
+	}
+
+	meta := &metav1.ObjectMeta{}
+	for _, op := range ops {
+		if op.Op != "add" && op.Op != "replace" {
+			continue
+		}
+		switch {
+		case op.Path == "/metadata":
+			m := metav1.ObjectMeta{}
+			if json.Unmarshal(op.Value, &m) == nil {
+				meta.Annotations = mergeMap(meta.Annotations, m.Annotations)
+				meta.Labels = mergeMap(meta.Labels, m.Labels)
+			}
+		case op.Path == "/metadata/annotations":
+			m := map[string]string{}
+			if json.Unmarshal(op.Value, &m) == nil {
+				meta.Annotations = mergeMap(meta.Annotations, m)
+			}
+		case op.Path == "/metadata/labels":
+			m := map[string]string{}
+			if json.Unmarshal(op.Value, &m) == nil {
+				meta.Labels = mergeMap(meta.Labels, m)
+			}
+		case strings.HasPrefix(op.Path, "/metadata/annotations/"):
+			var v string
+			if json.Unmarshal(op.Value, &v) == nil {
+				k := unescapeJSONPointer(strings.TrimPrefix(op.Path, "/metadata/annotations/"))
+				meta.Annotations = mergeMap(meta.Annotations, map[string]string{k: v})
+			}
+		case strings.HasPrefix(op.Path, "/metadata/labels/"):
+			var v string
+			if json.Unmarshal(op.Value, &v) == nil {
+				k := unescapeJSONPointer(strings.TrimPrefix(op.Path, "/metadata/labels/"))
+				meta.Labels = mergeMap(meta.Labels, map[string]string{k: v})
+			}
+		}
+	}
+	return meta, nil
+}
+
+func mergeMap(dst, src map[string]string) map[string]string {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = map[string]string{}
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+// unescapeJSONPointer unescapes a JSON pointer token, see RFC 6901.
+func unescapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~1", "/", -1), "~0", "~", -1)
+}
@@ -0,0 +1,349 @@
+package auditlog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+	clientsetscheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestBodyMeta(t *testing.T) {
+	cases := []struct {
+		name        string
+		body        string
+		annotations map[string]string
+		labels      map[string]string
+	}{
+		{
+			name:        "object",
+			body:        `{"kind":"Deployment","metadata":{"name":"foo","annotations":{"a":"1"},"labels":{"l":"2"}}}`,
+			annotations: map[string]string{"a": "1"},
+			labels:      map[string]string{"l": "2"},
+		},
+		{
+			name:        "merge patch",
+			body:        `{"metadata":{"annotations":{"a":"1"}}}`,
+			annotations: map[string]string{"a": "1"},
+		},
+		{
+			name: "json patch",
+			body: `[{"op":"add","path":"/metadata/annotations/example.com~1commit","value":"1"},
+				{"op":"replace","path":"/metadata/labels","value":{"l":"2"}},
+				{"op":"remove","path":"/metadata/annotations/b"},
+				{"op":"replace","path":"/spec/replicas","value":3}]`,
+			annotations: map[string]string{"example.com/commit": "1"},
+			labels:      map[string]string{"l": "2"},
+		},
+		{
+			name: "status",
+			body: `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","code":409}`,
+		},
+	}
+
+	for _, c := range cases {
+		meta, err := bodyMeta(&runtime.Unknown{Raw: []byte(c.body)})
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !equalMaps(meta.Annotations, c.annotations) {
+			t.Errorf("%s: expected annotations %v, got %v", c.name, c.annotations, meta.Annotations)
+		}
+		if !equalMaps(meta.Labels, c.labels) {
+			t.Errorf("%s: expected labels %v, got %v", c.name, c.labels, meta.Labels)
+		}
+	}
+}
+
+func equalMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCorrelateRequestAndObjectRef(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	ref := &v1beta1.ObjectReference{Resource: "deployments", Namespace: "prod", APIGroup: "apps", APIVersion: "v1"}
+
+	// a failed create only carries the annotation in its request
+	failed := newObjectEvent("a", v1beta1.StageResponseComplete, now,
+		`{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","reason":"Invalid","code":422}`)
+	failed.RequestObject = &runtime.Unknown{Raw: []byte(`{"kind":"Deployment","metadata":{"name":"foo","annotations":{"git-commit-hash":"abc"}}}`)}
+	failed.ObjectRef = ref.DeepCopy()
+
+	// a Metadata level event on the same object has no body at all
+	metadata := newObjectEvent("b", v1beta1.StageResponseComplete, now.Add(time.Second), "")
+	metadata.Verb = "get"
+	metadata.ObjectRef = ref.DeepCopy()
+	metadata.ObjectRef.Name = "foo"
+
+	// nor has one on an object never seen with a correlation
+	unknown := newObjectEvent("c", v1beta1.StageResponseComplete, now, "")
+	unknown.ObjectRef = ref.DeepCopy()
+	unknown.ObjectRef.Name = "bar"
+
+	list := &v1beta1.EventList{Items: []v1beta1.Event{failed, metadata, unknown}}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	if from := records[0].Correlations[0].From; records[0].Event.AuditID != "a" || from != FromRequestObject {
+		t.Errorf("expected event a correlated by its request, got %s from %s", records[0].Event.AuditID, from)
+	}
+	if from := records[1].Correlations[0].From; records[1].Event.AuditID != "b" || from != FromObjectRef {
+		t.Errorf("expected event b correlated by its object, got %s from %s", records[1].Event.AuditID, from)
+	}
+}
+
+func TestCorrelateByObjectUID(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	ref := func(name, subresource string) *v1beta1.ObjectReference {
+		return &v1beta1.ObjectReference{Resource: "deployments", Namespace: "prod", Name: name, APIGroup: "apps", APIVersion: "v1", Subresource: subresource}
+	}
+
+	create := newObjectEvent("a", v1beta1.StageResponseComplete, now,
+		`{"kind":"Deployment","metadata":{"name":"foo","namespace":"prod","uid":"u1","annotations":{"git-commit-hash":"abc"}}}`)
+	create.ObjectRef = ref("", "")
+
+	scale := newObjectEvent("b", v1beta1.StageResponseComplete, now.Add(time.Second),
+		`{"kind":"Scale","apiVersion":"autoscaling/v1","metadata":{"name":"foo","namespace":"prod","uid":"u1"},"spec":{"replicas":3}}`)
+	scale.Verb = "update"
+	scale.ObjectRef = ref("foo", "scale")
+
+	del := newObjectEvent("c", v1beta1.StageResponseComplete, now.Add(2*time.Second),
+		`{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Success"}`)
+	del.Verb = "delete"
+	del.ObjectRef = ref("foo", "")
+
+	// an unrelated object reusing the name
+	recreate := newObjectEvent("d", v1beta1.StageResponseComplete, now.Add(3*time.Second),
+		`{"kind":"Deployment","metadata":{"name":"foo","namespace":"prod","uid":"u2"}}`)
+	recreate.ObjectRef = ref("", "")
+
+	list := &v1beta1.EventList{Items: []v1beta1.Event{create, scale, del}}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ProcessEvents(&v1beta1.EventList{Items: []v1beta1.Event{recreate}}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		id   string
+		from string
+	}{
+		{"a", FromResponseObject},
+		{"b", FromObjectUID},
+		{"c", FromObjectRef},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %+v", len(expected), records)
+	}
+	for i, e := range expected {
+		if id, from := string(records[i].Event.AuditID), records[i].Correlations[0].From; id != e.id || from != e.from {
+			t.Errorf("expected event %s correlated from %s, got %s from %s", e.id, e.from, id, from)
+		}
+	}
+}
+
+func TestCorrelateByOwnerReference(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	deploy := newObjectEvent("a", v1beta1.StageResponseComplete, now,
+		`{"kind":"Deployment","metadata":{"name":"foo","namespace":"prod","uid":"d1","annotations":{"git-commit-hash":"abc"}}}`)
+	deploy.ObjectRef = &v1beta1.ObjectReference{Resource: "deployments", Namespace: "prod", APIGroup: "apps"}
+
+	rs := newObjectEvent("b", v1beta1.StageResponseComplete, now.Add(time.Second),
+		`{"kind":"ReplicaSet","metadata":{"name":"foo-1","namespace":"prod","uid":"r1","ownerReferences":[{"kind":"Deployment","name":"foo","uid":"d1","controller":true}]}}`)
+	rs.ObjectRef = &v1beta1.ObjectReference{Resource: "replicasets", Namespace: "prod", APIGroup: "apps"}
+
+	pod := newObjectEvent("c", v1beta1.StageResponseComplete, now.Add(2*time.Second),
+		`{"kind":"Pod","metadata":{"name":"foo-1-x","namespace":"prod","uid":"p1","ownerReferences":[{"kind":"ReplicaSet","name":"foo-1","uid":"r1","controller":true}]}}`)
+	pod.ObjectRef = &v1beta1.ObjectReference{Resource: "pods", Namespace: "prod"}
+
+	// later events on the pod stay indirect
+	status := newObjectEvent("d", v1beta1.StageResponseComplete, now.Add(3*time.Second), "")
+	status.Verb = "patch"
+	status.ObjectRef = &v1beta1.ObjectReference{Resource: "pods", Namespace: "prod", Name: "foo-1-x", UID: "p1", Subresource: "status"}
+
+	// owned by an object that was never correlated
+	orphan := newObjectEvent("e", v1beta1.StageResponseComplete, now.Add(4*time.Second),
+		`{"kind":"Pod","metadata":{"name":"bar","namespace":"prod","uid":"p2","ownerReferences":[{"kind":"ReplicaSet","name":"bar","uid":"r2"}]}}`)
+	orphan.ObjectRef = &v1beta1.ObjectReference{Resource: "pods", Namespace: "prod"}
+
+	list := &v1beta1.EventList{Items: []v1beta1.Event{deploy, rs, pod, status, orphan}}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		id       string
+		from     string
+		indirect bool
+	}{
+		{"a", FromResponseObject, false},
+		{"b", FromOwnerReference, true},
+		{"c", FromOwnerReference, true},
+		{"d", FromObjectUID, true},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %+v", len(expected), records)
+	}
+	for i, e := range expected {
+		rec := records[i]
+		if id, from := string(rec.Event.AuditID), rec.Correlations[0].From; id != e.id || from != e.from || rec.Indirect != e.indirect {
+			t.Errorf("expected event %s correlated from %s with indirect %v, got %s from %s with indirect %v", e.id, e.from, e.indirect, id, from, rec.Indirect)
+		}
+	}
+}
+
+func TestCorrelateListItems(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	del := newObjectEvent("a", v1beta1.StageResponseComplete, now,
+		`{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"10"},"items":[
+			{"metadata":{"name":"foo","namespace":"prod","uid":"p1","annotations":{"git-commit-hash":"abc"}}},
+			{"metadata":{"name":"bar","namespace":"prod","uid":"p2","annotations":{"git-commit-hash":"def"}}},
+			{"metadata":{"name":"baz","namespace":"prod","uid":"p3"}},
+			{"metadata":{"name":"qux","namespace":"prod","uid":"p4","annotations":{"git-commit-hash":"abc"}}}]}`)
+	del.Verb = "deletecollection"
+	del.ObjectRef = &v1beta1.ObjectReference{Resource: "pods", Namespace: "prod", APIVersion: "v1"}
+
+	if err := r.ProcessEvents(&v1beta1.EventList{Items: []v1beta1.Event{del}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for hash, names := range map[string][]string{"abc": {"foo", "qux"}, "def": {"bar"}} {
+		records, err := storedRecords(r.store, commit(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("expected 1 record for %s, got %+v", hash, records)
+		}
+		rec := records[0]
+		if len(rec.Correlations) != 2 {
+			t.Errorf("expected correlations with abc and def, got %+v", rec.Correlations)
+		}
+		var matched []string
+		for _, item := range rec.Items {
+			if item.Correlations[0].Value == hash {
+				matched = append(matched, item.Name)
+			}
+		}
+		if len(rec.Items) != 3 || strings.Join(matched, ",") != strings.Join(names, ",") {
+			t.Errorf("expected items %v matching %s, got %+v", names, hash, rec.Items)
+		}
+	}
+
+	// object kinds may end in List too, and even have a list of items
+	obj := newObjectEvent("b", v1beta1.StageResponseComplete, now,
+		`{"kind":"IPAllowList","apiVersion":"example.com/v1","metadata":{"name":"allow","namespace":"prod","annotations":{"git-commit-hash":"ghi"}},"items":["10.0.0.0/8"]}`)
+	obj.ObjectRef = &v1beta1.ObjectReference{Resource: "ipallowlists", APIGroup: "example.com", Namespace: "prod", Name: "allow"}
+	if err := r.ProcessEvents(&v1beta1.EventList{Items: []v1beta1.Event{obj}}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := storedRecords(r.store, commit("ghi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Items) != 0 {
+		t.Errorf("expected 1 record without items for ghi, got %+v", records)
+	}
+}
+
+func TestCorrelateNonJSONBodies(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	const protobuf = "application/vnd.kubernetes.protobuf"
+	info, ok := runtime.SerializerInfoForMediaType(clientsetscheme.Codecs.SupportedMediaTypes(), protobuf)
+	if !ok {
+		t.Fatalf("no serializer for %s", protobuf)
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "foo",
+		Namespace:   "prod",
+		UID:         "p1",
+		Annotations: map[string]string{"git-commit-hash": "abc"},
+	}}
+	var buf bytes.Buffer
+	if err := clientsetscheme.Codecs.EncoderForVersion(info.Serializer, corev1.SchemeGroupVersion).Encode(pod, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	ref := &v1beta1.ObjectReference{Resource: "pods", Namespace: "prod", Name: "foo", UID: "p1", APIVersion: "v1"}
+	create := newObjectEvent("a", v1beta1.StageResponseComplete, now, "")
+	create.ObjectRef = ref
+	create.ResponseObject = &runtime.Unknown{Raw: buf.Bytes(), ContentType: protobuf}
+
+	garbled := newObjectEvent("b", v1beta1.StageResponseComplete, now.Add(time.Second), "")
+	garbled.Verb = "update"
+	garbled.ObjectRef = ref
+	garbled.RequestObject = &runtime.Unknown{Raw: []byte("k8s\x00garbled"), ContentType: protobuf}
+	garbled.ResponseObject = &runtime.Unknown{Raw: []byte(`{"kind":`), ContentType: runtime.ContentTypeJSON}
+
+	list := &v1beta1.EventList{Items: []v1beta1.Event{create, garbled}}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	if body := records[0].Event.ResponseObject; body == nil || body.ContentType != runtime.ContentTypeJSON || !bytes.Contains(body.Raw, []byte(`"git-commit-hash":"abc"`)) {
+		t.Errorf("expected the protobuf body converted to JSON, got %+v", body)
+	}
+	rec := records[1]
+	if rec.Event.RequestObject != nil || rec.Event.ResponseObject != nil {
+		t.Errorf("expected undecodable bodies removed from the event, got %+v", rec.Event)
+	}
+	if rec.OpaqueRequestObject == nil || rec.OpaqueRequestObject.ContentType != protobuf || string(rec.OpaqueRequestObject.Raw) != "k8s\x00garbled" {
+		t.Errorf("expected the request body kept as opaque bytes, got %+v", rec.OpaqueRequestObject)
+	}
+	if rec.OpaqueResponseObject == nil || string(rec.OpaqueResponseObject.Raw) != `{"kind":` {
+		t.Errorf("expected the response body kept as opaque bytes, got %+v", rec.OpaqueResponseObject)
+	}
+}
@@ -0,0 +1,84 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+	clientsetscheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+// defaultEventListKind is assumed for payloads without apiVersion and kind.
+var defaultEventListKind = storageVersion.WithKind("EventList")
+
+// errUnsupportedMediaType is returned for payloads none of the Codecs decode.
+type errUnsupportedMediaType struct {
+	contentType string
+}
+
+func (e errUnsupportedMediaType) Error() string {
+	return fmt.Sprintf("unsupported media type %q", e.contentType)
+}
+
+// decodeEventList decodes an audit.k8s.io EventList of any supported version
+// and media type to the internal type, and converts it to the storage
+// version. An empty contentType is treated as JSON.
+func decodeEventList(data []byte, contentType string) (*v1beta1.EventList, error) {
+	mediaType := runtime.ContentTypeJSON
+	if contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, errUnsupportedMediaType{contentType}
+		}
+	}
+	info, ok := runtime.SerializerInfoForMediaType(Codecs.SupportedMediaTypes(), mediaType)
+	if !ok {
+		return nil, errUnsupportedMediaType{contentType}
+	}
+
+	decoder := Codecs.DecoderToVersion(info.Serializer, runtime.InternalGroupVersioner)
+	obj, gvk, err := decoder.Decode(data, &defaultEventListKind, nil)
+	if err != nil {
+		return nil, err
+	}
+	internal, ok := obj.(*audit.EventList)
+	if !ok {
+		return nil, fmt.Errorf("expected %s, got %s", schema.GroupKind{Group: audit.GroupName, Kind: "EventList"}, gvk)
+	}
+
+	list := &v1beta1.EventList{}
+	if err := Scheme.Convert(internal, list, nil); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// bodyDecoder decodes request and response bodies of the built-in kinds from
+// any media type the apiserver records them in.
+var bodyDecoder = clientsetscheme.Codecs.UniversalDeserializer()
+
+// jsonBody returns obj with its payload in JSON. Payloads of other media
+// types, like protobuf, are decoded as one of the built-in kinds and encoded
+// as JSON in the version they were recorded in.
+func jsonBody(obj *runtime.Unknown) (*runtime.Unknown, error) {
+	if obj == nil || obj.ContentType == "" || obj.ContentType == runtime.ContentTypeJSON {
+		return obj, nil
+	}
+	if obj.ContentEncoding != "" {
+		return nil, fmt.Errorf("unsupported content encoding %q", obj.ContentEncoding)
+	}
+	decoded, gvk, err := bodyDecoder.Decode(obj.Raw, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	decoded.GetObjectKind().SetGroupVersionKind(*gvk)
+	raw, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return &runtime.Unknown{Raw: raw, ContentType: runtime.ContentTypeJSON}, nil
+}
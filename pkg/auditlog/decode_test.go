@@ -0,0 +1,131 @@
+package auditlog
+
+import (
+	"bytes"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/apis/audit/v1alpha1"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestDecodeEventList(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		err  bool
+	}{
+		{
+			name: "v1alpha1",
+			data: `{"kind":"EventList","apiVersion":"audit.k8s.io/v1alpha1","items":[
+				{"level":"Metadata","auditID":"a","stage":"ResponseComplete","verb":"create",
+				 "objectRef":{"resource":"deployments","namespace":"prod","name":"foo","apiVersion":"apps/v1"}}]}`,
+		},
+		{
+			name: "v1beta1",
+			data: `{"kind":"EventList","apiVersion":"audit.k8s.io/v1beta1","items":[
+				{"level":"Metadata","auditID":"a","stage":"ResponseComplete","verb":"create",
+				 "objectRef":{"resource":"deployments","namespace":"prod","name":"foo","apiGroup":"apps","apiVersion":"v1"}}]}`,
+		},
+		{
+			name: "v1",
+			data: `{"kind":"EventList","apiVersion":"audit.k8s.io/v1","items":[
+				{"level":"Metadata","auditID":"a","stage":"ResponseComplete","verb":"create",
+				 "objectRef":{"resource":"deployments","namespace":"prod","name":"foo","apiGroup":"apps","apiVersion":"v1"}}]}`,
+		},
+		{
+			name: "no type meta",
+			data: `{"items":[
+				{"level":"Metadata","auditID":"a","stage":"ResponseComplete","verb":"create",
+				 "objectRef":{"resource":"deployments","namespace":"prod","name":"foo","apiGroup":"apps","apiVersion":"v1"}}]}`,
+		},
+		{
+			name: "unknown version",
+			data: `{"kind":"EventList","apiVersion":"audit.k8s.io/v2","items":[]}`,
+			err:  true,
+		},
+		{
+			name: "wrong kind",
+			data: `{"kind":"Policy","apiVersion":"audit.k8s.io/v1beta1","rules":[]}`,
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		list, err := decodeEventList([]byte(c.data), "application/json")
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(list.Items) != 1 {
+			t.Errorf("%s: expected 1 event, got %d", c.name, len(list.Items))
+			continue
+		}
+		ev := list.Items[0]
+		if ev.AuditID != "a" || ev.Stage != v1beta1.StageResponseComplete || ev.Verb != "create" {
+			t.Errorf("%s: unexpected event %+v", c.name, ev)
+		}
+		if ev.ObjectRef == nil || ev.ObjectRef.APIGroup != "apps" || ev.ObjectRef.APIVersion != "v1" || ev.ObjectRef.Name != "foo" {
+			t.Errorf("%s: unexpected object reference %+v", c.name, ev.ObjectRef)
+		}
+	}
+}
+
+func TestDecodeProtobufEventList(t *testing.T) {
+	const protobuf = "application/vnd.kubernetes.protobuf"
+	info, ok := runtime.SerializerInfoForMediaType(Codecs.SupportedMediaTypes(), protobuf)
+	if !ok {
+		t.Fatalf("no serializer for %s", protobuf)
+	}
+
+	lists := []runtime.Object{
+		&v1beta1.EventList{
+			Items: []v1beta1.Event{{
+				AuditID:        "a",
+				Stage:          v1beta1.StageResponseComplete,
+				Verb:           "create",
+				ObjectRef:      &v1beta1.ObjectReference{Resource: "deployments", Name: "foo", APIGroup: "apps", APIVersion: "v1"},
+				ResponseObject: &runtime.Unknown{Raw: []byte(`{"kind":"Deployment"}`), ContentType: runtime.ContentTypeJSON},
+			}},
+		},
+		&v1alpha1.EventList{
+			Items: []v1alpha1.Event{{
+				AuditID:   "a",
+				Stage:     v1alpha1.StageResponseComplete,
+				Verb:      "create",
+				ObjectRef: &v1alpha1.ObjectReference{Resource: "deployments", Name: "foo", APIVersion: "apps/v1"},
+			}},
+		},
+	}
+	for _, obj := range lists {
+		gv := v1beta1.SchemeGroupVersion
+		if _, ok := obj.(*v1alpha1.EventList); ok {
+			gv = v1alpha1.SchemeGroupVersion
+		}
+		var buf bytes.Buffer
+		if err := Codecs.EncoderForVersion(info.Serializer, gv).Encode(obj, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := decodeEventList(buf.Bytes(), protobuf+"; charset=utf-8")
+		if err != nil {
+			t.Errorf("%s: %v", gv, err)
+			continue
+		}
+		if len(list.Items) != 1 || list.Items[0].AuditID != "a" || list.Items[0].ObjectRef.APIGroup != "apps" {
+			t.Errorf("%s: unexpected events %+v", gv, list.Items)
+		}
+	}
+
+	if _, err := decodeEventList([]byte("a,b"), "text/csv"); err == nil {
+		t.Error("expected an error for an unsupported media type")
+	} else if _, ok := err.(errUnsupportedMediaType); !ok {
+		t.Errorf("expected errUnsupportedMediaType, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package auditlog
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/apiserver/pkg/storage/value"
+	aestransformer "k8s.io/apiserver/pkg/storage/value/encrypt/aes"
+)
+
+// Encryption modes of EncryptionKey.
+const (
+	ModeAESGCM   = "aesgcm"
+	ModeAESCBC   = "aescbc"
+	ModeIdentity = "identity"
+)
+
+// encryptedPrefix starts the values written by the AES transformers, which
+// are prefixed with encryptedPrefix<mode>:v1:<key name>: like the values of
+// the apiserver encryption providers.
+const encryptedPrefix = "k8s:enc:"
+
+// EncryptionConfig is the key set of an encrypted store:
+//
+//	keys:
+//	- name: key2
+//	  secret: <base64 encoded 16, 24 or 32 byte AES key>
+//	- name: key1
+//	  mode: aescbc
+//	  secret: <base64 encoded key>
+//
+// Values are written with the first key and read with any of them. Values
+// read with another key than the first are re-encrypted in the background, so
+// a key is rotated by adding a new key first and removing the old one once it
+// is no longer in use. A first key with the identity mode writes plaintext.
+// Values written before the store was encrypted are always readable.
+type EncryptionConfig struct {
+	Keys []EncryptionKey `json:"keys"`
+}
+
+// EncryptionKey is a named key of an EncryptionConfig.
+type EncryptionKey struct {
+	Name string `json:"name"`
+	// Mode is aesgcm, aescbc or identity. It defaults to aesgcm.
+	Mode   string `json:"mode,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// LoadEncryptionConfig reads an EncryptionConfig and returns the transformer
+// of its key set.
+func LoadEncryptionConfig(path string) (value.Transformer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption config %s: %v", path, err)
+	}
+	config := &EncryptionConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse encryption config %s: %v", path, err)
+	}
+	transformer, err := config.transformer()
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption config %s: %v", path, err)
+	}
+	return transformer, nil
+}
+
+func (c *EncryptionConfig) transformer() (value.Transformer, error) {
+	if len(c.Keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+
+	var transformers []value.PrefixTransformer
+	names := map[string]bool{}
+	plaintext := false
+	for _, k := range c.Keys {
+		if k.Name == "" || strings.Contains(k.Name, ":") {
+			return nil, fmt.Errorf("invalid key name %q", k.Name)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("duplicate key name %q", k.Name)
+		}
+		names[k.Name] = true
+
+		mode := k.Mode
+		if mode == "" {
+			mode = ModeAESGCM
+		}
+		if mode == ModeIdentity {
+			transformers = append(transformers, value.PrefixTransformer{Transformer: plaintextTransformer{}})
+			plaintext = true
+			continue
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid secret: %v", k.Name, err)
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.Name, err)
+		}
+		var t value.Transformer
+		switch mode {
+		case ModeAESGCM:
+			t = aestransformer.NewGCMTransformer(block)
+		case ModeAESCBC:
+			t = aestransformer.NewCBCTransformer(block)
+		default:
+			return nil, fmt.Errorf("key %s: unknown mode %q", k.Name, k.Mode)
+		}
+		transformers = append(transformers, value.PrefixTransformer{
+			Prefix:      []byte(encryptedPrefix + mode + ":v1:" + k.Name + ":"),
+			Transformer: t,
+		})
+	}
+	if !plaintext {
+		transformers = append(transformers, value.PrefixTransformer{Transformer: plaintextTransformer{}})
+	}
+	return value.NewPrefixTransformers(fmt.Errorf("value is encrypted with a key missing from the encryption config"), transformers...), nil
+}
+
+// encryptionKeyName returns the name of the key a stored value is encrypted
+// with, or "" for plaintext values.
+func encryptionKeyName(data []byte) string {
+	if !bytes.HasPrefix(data, []byte(encryptedPrefix)) {
+		return ""
+	}
+	// <mode>:v1:<name>:<ciphertext>
+	parts := strings.SplitN(string(data[len(encryptedPrefix):]), ":", 4)
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[2]
+}
+
+// plaintextTransformer stores values as they are. It refuses encrypted
+// values, so that the next key of the key set is tried.
+type plaintextTransformer struct{}
+
+func (plaintextTransformer) TransformFromStorage(data []byte, _ value.Context) ([]byte, bool, error) {
+	if bytes.HasPrefix(data, []byte(encryptedPrefix)) {
+		return nil, false, fmt.Errorf("value is encrypted")
+	}
+	return data, false, nil
+}
+
+func (plaintextTransformer) TransformToStorage(data []byte, _ value.Context) ([]byte, error) {
+	return data, nil
+}
+
+// Reencrypt rewrites the stored values that are not encrypted with the first
+// key of the encryption config, a chunk per store update, and returns their
+// number. It runs against a live store and may be interrupted at any point:
+// when stop is closed, it returns before the next chunk, and the remaining
+// values are rewritten by the next run.
+func (s *Store) Reencrypt(stop <-chan struct{}) (int, error) {
+	if s.transformer == nil {
+		return 0, nil
+	}
+	rewritten := 0
+	var start []byte
+	for {
+		select {
+		case <-stop:
+			return rewritten, nil
+		default:
+		}
+		var last []byte
+		err := s.update(func(r leveldb.Reader) (*leveldb.Batch, error) {
+			b := new(leveldb.Batch)
+			iter := r.NewIterator(&util.Range{Start: start}, nil)
+			defer iter.Release()
+			for n := 0; n < migrationChunkSize && iter.Next(); n++ {
+				key, data := iter.Key(), iter.Value()
+				last = append(last[:0], key...)
+				if !storedValue(key, data) {
+					continue
+				}
+				ctx := value.DefaultContext(key)
+				plain, stale, err := s.transformer.TransformFromStorage(data, ctx)
+				if err != nil {
+					return nil, fmt.Errorf("failed to decrypt %s: %v", key, err)
+				}
+				if !stale {
+					continue
+				}
+				data, err = s.transformer.TransformToStorage(plain, ctx)
+				if err != nil {
+					return nil, err
+				}
+				b.Put(key, data)
+				rewritten++
+			}
+			return b, iter.Error()
+		})
+		if err != nil {
+			return rewritten, err
+		}
+		if last == nil {
+			return rewritten, nil
+		}
+		start = append(last, 0)
+	}
+}
+
+// KeyUsage returns the number of stored values encrypted with each key, by
+// key name. Plaintext values are counted under the empty name.
+func (s *Store) KeyUsage() (map[string]int, error) {
+	usage := map[string]int{}
+	err := s.view(func(r leveldb.Reader) error {
+		iter := r.NewIterator(nil, nil)
+		defer iter.Release()
+		for iter.Next() {
+			if storedValue(iter.Key(), iter.Value()) {
+				usage[encryptionKeyName(iter.Value())]++
+			}
+		}
+		return iter.Error()
+	})
+	return usage, err
+}
@@ -0,0 +1,143 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+func TestEncryptionTransformers(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	for _, mode := range []string{ModeAESGCM, ModeAESCBC} {
+		c := &EncryptionConfig{Keys: []EncryptionKey{{Name: "k", Mode: mode, Secret: secret}}}
+		tr, err := c.transformer()
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		ctx := value.DefaultContext("key")
+		for _, data := range []string{"", "a", "0123456789abcdef", `{"event":{}}`} {
+			stored, err := tr.TransformToStorage([]byte(data), ctx)
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			prefix := encryptedPrefix + mode + ":v1:k:"
+			if name := encryptionKeyName(stored); name != "k" || (len(data) >= 8 && bytes.Contains(stored[len(prefix):], []byte(data))) {
+				t.Errorf("%s: expected %q encrypted with k, got %q", mode, data, stored)
+			}
+			out, stale, err := tr.TransformFromStorage(stored, ctx)
+			if err != nil || stale || string(out) != data {
+				t.Errorf("%s: expected %q, got %q, %v, %v", mode, data, out, stale, err)
+			}
+		}
+	}
+
+	for _, c := range []EncryptionConfig{
+		{},
+		{Keys: []EncryptionKey{{Name: "k", Secret: "short"}}},
+		{Keys: []EncryptionKey{{Name: "a:b", Secret: secret}}},
+		{Keys: []EncryptionKey{{Name: "k", Secret: secret}, {Name: "k", Secret: secret}}},
+		{Keys: []EncryptionKey{{Name: "k", Mode: "rot13", Secret: secret}}},
+	} {
+		if _, err := c.transformer(); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
+
+func TestStoreKeyRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key := func(name string, b byte) EncryptionKey {
+		return EncryptionKey{Name: name, Secret: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))}
+	}
+	open := func(keys ...EncryptionKey) *Store {
+		var tr value.Transformer
+		if len(keys) > 0 {
+			var err error
+			if tr, err = (&EncryptionConfig{Keys: keys}).transformer(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s, err := OpenStore(dir, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	write := func(s *Store, id string) {
+		r := &Receiver{store: s, keys: NewOptions().correlationKeys(), redactor: &redactor{}}
+		ev := newEvent(id, v1beta1.StageResponseComplete, time.Now(), "abc")
+		if err := r.ProcessEvents(&v1beta1.EventList{Items: []v1beta1.Event{ev}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(s *Store, records int, usage map[string]int) {
+		recs, err := storedRecords(s, commit("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != records {
+			t.Errorf("expected %d records, got %d", records, len(recs))
+		}
+		got, err := s.KeyUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name := range usage {
+			if (got[name] == 0) != (usage[name] == 0) {
+				t.Errorf("expected key usage %v, got %v", usage, got)
+				break
+			}
+		}
+	}
+
+	// plaintext values are encrypted once keys are configured
+	s := open()
+	write(s, "a")
+	s.Close()
+	s = open(key("k1", 1))
+	check(s, 1, map[string]int{"": 1, "k1": 0})
+	stop := make(chan struct{})
+	close(stop)
+	if n, err := s.Reencrypt(stop); err != nil || n != 0 {
+		t.Fatalf("expected a stopped re-encryption to rewrite nothing, got %d, %v", n, err)
+	}
+	check(s, 1, map[string]int{"": 1, "k1": 0})
+	if _, err := s.Reencrypt(nil); err != nil {
+		t.Fatal(err)
+	}
+	write(s, "b")
+	check(s, 2, map[string]int{"": 0, "k1": 1})
+	s.Close()
+
+	// k1 is rotated to k2
+	s = open(key("k2", 2), key("k1", 1))
+	write(s, "c")
+	check(s, 3, map[string]int{"k1": 1, "k2": 1})
+	if _, err := s.Reencrypt(nil); err != nil {
+		t.Fatal(err)
+	}
+	check(s, 3, map[string]int{"k1": 0, "k2": 1})
+	s.Close()
+
+	// k1 is no longer needed, but k2 is
+	s = open(key("k2", 2))
+	check(s, 3, map[string]int{"k2": 1})
+	s.Close()
+	s = open(key("k1", 1))
+	if _, err := storedRecords(s, commit("abc")); err == nil {
+		t.Error("expected an error reading values encrypted with a missing key")
+	}
+	s.Close()
+	s = open()
+	if _, err := storedRecords(s, commit("abc")); err == nil {
+		t.Error("expected an error reading encrypted values without keys")
+	}
+	s.Close()
+}
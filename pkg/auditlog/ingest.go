@@ -0,0 +1,286 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+// ingestEvent is an event considered for storage.
+type ingestEvent struct {
+	// record holds the event and the correlations found in its bodies.
+	record *Record
+	// uidKey and objectKey identify the object the event is about, if known.
+	uidKey    []byte
+	objectKey []byte
+	// ownerKeys are the UID keys of the owners of the object.
+	ownerKeys [][]byte
+}
+
+// extract selects the events of list that match a correlation key, or may be
+// attributed to one by their object. It does not touch the store, so it runs
+// outside of store updates. Events with undecodable bodies are kept with
+// their bodies as opaque bytes. With an audit policy, events are dropped or
+// downgraded by it, after their bodies are correlated. Sensitive values are
+// redacted last.
+func (r *Receiver) extract(list *v1beta1.EventList) ([]*ingestEvent, error) {
+	if list == nil {
+		return nil, fmt.Errorf("empty event list")
+	}
+
+	var events []*ingestEvent
+	for i := range list.Items {
+		ev := &list.Items[i]
+		var level v1beta1.Level
+		if r.policy != nil {
+			var ok bool
+			if level, ok = r.policy.level(ev); !ok {
+				continue
+			}
+		}
+		ie := r.correlateEvent(ev)
+		if level != "" {
+			applyLevel(ie.record, level)
+		}
+		r.redactor.redact(ie.record)
+		if len(ie.record.Correlations) == 0 && ie.uidKey == nil && ie.objectKey == nil && len(ie.ownerKeys) == 0 {
+			continue
+		}
+		events = append(events, ie)
+	}
+	return events, nil
+}
+
+// storeEvents commits events with a single store update. Events that are
+// already stored, or repeated within events, are identified by their audit
+// ID and stage and skipped, so retried webhook batches never produce
+// duplicates.
+func (r *Receiver) storeEvents(events []*ingestEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return r.store.Update(func(db leveldb.Reader, b *leveldb.Batch) error {
+		txn := newWriteTxn(db, b)
+		for _, ie := range events {
+			if err := txn.putEvent(ie); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeTxn records the writes of one store update and lets later writes of the
+// same update observe earlier ones.
+type writeTxn struct {
+	db      leveldb.Reader
+	b       *leveldb.Batch
+	pending map[string][]byte
+	deleted map[string]bool
+	// seq is the last sequence number of the event log, once loaded.
+	seq       uint64
+	seqLoaded bool
+}
+
+func newWriteTxn(db leveldb.Reader, b *leveldb.Batch) *writeTxn {
+	return &writeTxn{db: db, b: b, pending: map[string][]byte{}, deleted: map[string]bool{}}
+}
+
+// get returns the value of key, or leveldb.ErrNotFound.
+func (t *writeTxn) get(key []byte) ([]byte, error) {
+	if t.deleted[string(key)] {
+		return nil, leveldb.ErrNotFound
+	}
+	if v, ok := t.pending[string(key)]; ok {
+		return v, nil
+	}
+	return t.db.Get(key, nil)
+}
+
+func (t *writeTxn) put(key, value []byte) {
+	delete(t.deleted, string(key))
+	t.pending[string(key)] = value
+	t.b.Put(key, value)
+}
+
+func (t *writeTxn) delete(key []byte) {
+	delete(t.pending, string(key))
+	t.deleted[string(key)] = true
+	t.b.Delete(key)
+}
+
+// putEvent stores the record of ie, its index entries and merges it into its
+// request unless an event with the same audit ID and stage is already stored.
+// Events without correlations of their own inherit the ones last seen on
+// their object or else on one of its owners, and events with correlations
+// update them.
+func (t *writeTxn) putEvent(ie *ingestEvent) error {
+	rec := ie.record
+	dk := dedupKey(&rec.Event)
+	if _, err := t.get(dk); err == nil {
+		return nil
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	if len(rec.Correlations) == 0 {
+		cs, indirect, err := t.inheritedCorrelations(ie)
+		if err != nil {
+			return err
+		}
+		rec.Correlations, rec.Indirect = cs, indirect
+	}
+	if len(rec.Correlations) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	key := eventKey(&rec.Event)
+	t.put(key, data)
+	for _, c := range rec.Correlations {
+		t.put(indexKey(c, &rec.Event), nil)
+	}
+	t.put(dk, key)
+	seq, err := t.nextSequence()
+	if err != nil {
+		return err
+	}
+	t.put(seqKey(seq), key)
+	if err := t.mergeRequest(rec); err != nil {
+		return err
+	}
+
+	if ie.uidKey != nil {
+		if err := t.putObjectCorrelations(ie.uidKey, rec.Correlations, rec.Indirect); err != nil {
+			return err
+		}
+	}
+	if ie.objectKey != nil {
+		// a deleted name may be reused by an unrelated object, while UIDs are
+		// never reused
+		if isDeleted(&rec.Event) {
+			t.delete(ie.objectKey)
+		} else if err := t.putObjectCorrelations(ie.objectKey, rec.Correlations, rec.Indirect); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextSequence returns the sequence number of the next event of the event
+// log. Writers are serialized, so the last logged event is read only once per
+// update.
+func (t *writeTxn) nextSequence() (uint64, error) {
+	if !t.seqLoaded {
+		seq, err := lastSequence(t.db)
+		if err != nil {
+			return 0, err
+		}
+		t.seq, t.seqLoaded = seq, true
+	}
+	t.seq++
+	return t.seq, nil
+}
+
+// lastSequence returns the sequence number of the last event of the event
+// log, or 0 if it is empty.
+func lastSequence(r leveldb.Reader) (uint64, error) {
+	iter := r.NewIterator(util.BytesPrefix([]byte(seqPrefix)), nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return 0, iter.Error()
+	}
+	seq, ok := parseSeqKey(iter.Key())
+	if !ok {
+		return 0, fmt.Errorf("invalid event log key %s", iter.Key())
+	}
+	return seq, nil
+}
+
+// inheritedCorrelations returns the correlations last seen on the object of
+// ie, looked up by UID first, or else on its owners. Correlations inherited
+// from owners, directly or through the object, are indirect.
+func (t *writeTxn) inheritedCorrelations(ie *ingestEvent) ([]Correlation, bool, error) {
+	type lookup struct {
+		key  []byte
+		from string
+	}
+	lookups := []lookup{
+		{ie.uidKey, FromObjectUID},
+		{ie.objectKey, FromObjectRef},
+	}
+	for _, key := range ie.ownerKeys {
+		lookups = append(lookups, lookup{key, FromOwnerReference})
+	}
+
+	for _, l := range lookups {
+		if l.key == nil {
+			continue
+		}
+		cs, err := t.objectCorrelations(l.key)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(cs) == 0 {
+			continue
+		}
+		indirect := l.from == FromOwnerReference
+		for i := range cs {
+			if cs[i].From == FromOwnerReference {
+				indirect = true
+			}
+			cs[i].From = l.from
+		}
+		return cs, indirect, nil
+	}
+	return nil, false, nil
+}
+
+// isDeleted reports whether ev completed the deletion of its object.
+func isDeleted(ev *v1beta1.Event) bool {
+	if ev.Verb != "delete" || ev.Stage != v1beta1.StageResponseComplete {
+		return false
+	}
+	return ev.ResponseStatus == nil || ev.ResponseStatus.Code/100 == 2
+}
+
+// objectCorrelations returns the correlations last seen on an object.
+func (t *writeTxn) objectCorrelations(key []byte) ([]Correlation, error) {
+	data, err := t.get(key)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cs []Correlation
+	if err := json.Unmarshal(data, &cs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal correlations of %s: %v", key, err)
+	}
+	return cs, nil
+}
+
+// putObjectCorrelations records the correlations of an object. Indirect
+// correlations are marked as coming from an owner, so that they stay indirect
+// when inherited.
+func (t *writeTxn) putObjectCorrelations(key []byte, cs []Correlation, indirect bool) error {
+	stripped := make([]Correlation, 0, len(cs))
+	for _, c := range cs {
+		c.From = ""
+		if indirect {
+			c.From = FromOwnerReference
+		}
+		stripped = append(stripped, c)
+	}
+	data, err := json.Marshal(stripped)
+	if err != nil {
+		return err
+	}
+	t.put(key, data)
+	return nil
+}
@@ -0,0 +1,175 @@
+package auditlog
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+// Store metadata lives under metaPrefix. The schema version marker records
+// the storage layout of the database, see migrate.go.
+const (
+	metaPrefix       = "meta/"
+	schemaVersionKey = metaPrefix + "schema-version"
+)
+
+// The migration of legacy blobs records what it read under metaPrefix, so
+// that a resumed migration verifies the events of every run: the counts of
+// the migrated blobs and events, and each distinct event by its dedup key.
+//
+//	meta/legacy-counts
+//	meta/legacy-event/dedup/<auditID>/<stage>
+const (
+	legacyCountsKey   = metaPrefix + "legacy-counts"
+	legacyEventPrefix = metaPrefix + "legacy-event/"
+)
+
+func legacyEventMetaKey(dk []byte) []byte {
+	return append([]byte(legacyEventPrefix), dk...)
+}
+
+// Every event is stored once as a Record, ordered by stage timestamp:
+//
+//	event/<stageTimestamp>/<auditID>/<stage>
+//
+// and indexed by every correlation key it matched, with an empty value:
+//
+//	index/<source>/<key>/<value>/<stageTimestamp>/<auditID>/<stage>
+//
+// Variable components are path escaped so they never contain the separator,
+// and the timestamp is formatted with a fixed width so that keys sort by time.
+const (
+	eventPrefix = "event/"
+	indexPrefix = "index/"
+
+	keyTimeFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+// eventID is the part of the event and index keys identifying an event.
+func eventID(ev *v1beta1.Event) string {
+	return ev.StageTimestamp.UTC().Format(keyTimeFormat) + "/" + url.PathEscape(string(ev.AuditID)) + "/" + string(ev.Stage)
+}
+
+func eventKey(ev *v1beta1.Event) []byte {
+	return []byte(eventPrefix + eventID(ev))
+}
+
+// indexKeyPrefix returns the prefix shared by all events correlated by c.
+func indexKeyPrefix(c Correlation) []byte {
+	return append(correlationKey{source: c.Source, key: c.Key}.indexPrefix(), url.PathEscape(c.Value)+"/"...)
+}
+
+// indexPrefix returns the prefix shared by all events correlated by k,
+// whatever their value.
+func (k correlationKey) indexPrefix() []byte {
+	return []byte(indexPrefix + k.source + "/" + url.PathEscape(k.key) + "/")
+}
+
+func indexKey(c Correlation, ev *v1beta1.Event) []byte {
+	return append(indexKeyPrefix(c), eventID(ev)...)
+}
+
+// parseIndexKey returns the correlation and the event key of an index key.
+func parseIndexKey(key []byte) (Correlation, []byte, bool) {
+	s := string(key)
+	if !strings.HasPrefix(s, indexPrefix) {
+		return Correlation{}, nil, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, indexPrefix), "/", 4)
+	if len(parts) != 4 {
+		return Correlation{}, nil, false
+	}
+	k, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return Correlation{}, nil, false
+	}
+	v, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return Correlation{}, nil, false
+	}
+	return Correlation{Source: parts[0], Key: k, Value: v}, []byte(eventPrefix + parts[3]), true
+}
+
+// Every stored event is indexed by its audit ID and stage, which identify it
+// across webhook retries:
+//
+//	dedup/<auditID>/<stage> -> event key
+const dedupPrefix = "dedup/"
+
+func dedupKey(ev *v1beta1.Event) []byte {
+	return []byte(dedupPrefix + url.PathEscape(string(ev.AuditID)) + "/" + string(ev.Stage))
+}
+
+// The correlations last seen on an object are kept by object UID and by
+// object identity, so events without a correlated body can be attributed by
+// their ObjectRef:
+//
+//	uid/<uid> -> []Correlation
+//	object/<group>/<resource>/<namespace>/<name> -> []Correlation
+const (
+	uidPrefix    = "uid/"
+	objectPrefix = "object/"
+)
+
+func uidKey(uid types.UID) []byte {
+	return []byte(uidPrefix + url.PathEscape(string(uid)))
+}
+
+func objectKey(group, resource, namespace, name string) []byte {
+	return []byte(objectPrefix + url.PathEscape(group) + "/" + url.PathEscape(resource) + "/" + url.PathEscape(namespace) + "/" + url.PathEscape(name))
+}
+
+// The stored stages of every API request are merged into a Request:
+//
+//	request/<auditID> -> Request
+const requestPrefix = "request/"
+
+func requestKey(auditID types.UID) []byte {
+	return []byte(requestPrefix + url.PathEscape(string(auditID)))
+}
+
+// Every stored event is also logged in the order it was stored, so that
+// watchers can resume from their position in the log:
+//
+//	seq/<sequence> -> event key
+//
+// Sequence numbers start at 1 and are zero padded so that keys sort by them.
+// Events stored before the log was introduced are not logged.
+const seqPrefix = "seq/"
+
+func seqKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", seqPrefix, seq))
+}
+
+func parseSeqKey(key []byte) (uint64, bool) {
+	if !bytes.HasPrefix(key, []byte(seqPrefix)) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(string(key[len(seqPrefix):]), 10, 64)
+	return seq, err == nil
+}
+
+// parseEventKeyAuditID returns the escaped audit ID of an event key.
+func parseEventKeyAuditID(key []byte) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(string(key), eventPrefix), "/")
+	if len(parts) != 3 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// isLegacyKey reports whether key is a schema version 1 key, which holds the
+// marshalled EventList of a commit under the bare commit hash.
+func isLegacyKey(key []byte) bool {
+	for _, prefix := range []string{metaPrefix, legacyCommitPrefix, dedupPrefix, eventPrefix, indexPrefix, uidPrefix, objectPrefix, requestPrefix, seqPrefix} {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return false
+		}
+	}
+	return true
+}
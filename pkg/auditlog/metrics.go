@@ -0,0 +1,54 @@
+package auditlog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "log_audit"
+
+var (
+	queueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ingest_queue_depth",
+			Help:      "Number of event batches waiting in the ingest queue.",
+		},
+	)
+	queueCapacity = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ingest_queue_capacity",
+			Help:      "Maximum number of event batches the ingest queue holds.",
+		},
+	)
+	rejectedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ingest_rejected_batches_total",
+			Help:      "Number of event batches rejected because the ingest queue was full.",
+		},
+	)
+	writeBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "ingest_write_batch_size",
+			Help:      "Number of event batches committed by a single store write.",
+			Buckets:   prometheus.LinearBuckets(1, 4, 8),
+		},
+	)
+	opaqueBodies = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ingest_opaque_bodies_total",
+			Help:      "Number of request and response bodies stored as opaque bytes because they could not be decoded.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(queueCapacity)
+	prometheus.MustRegister(rejectedCounter)
+	prometheus.MustRegister(writeBatchSize)
+	prometheus.MustRegister(opaqueBodies)
+}
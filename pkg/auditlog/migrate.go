@@ -0,0 +1,624 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+// SchemaVersion is the storage layout written by this receiver.
+//
+//	1: one marshalled EventList per commit, keyed by the bare commit hash
+//	2: one event per key, see keys.go
+//	3: events indexed by audit ID and stage
+//	4: events stored once as Records and indexed by every correlation key
+//	5: correlations indexed by object
+//	6: correlations indexed by object UID
+//	7: stages merged into requests by audit ID
+//	8: bodies of records and requests redacted
+const SchemaVersion = 8
+
+// MigrationResult summarizes a Migrate run.
+type MigrationResult struct {
+	FromVersion int
+	ToVersion   int
+
+	// Commits is the number of legacy commit blobs rewritten.
+	Commits int
+	// LegacyEvents is the number of events read from legacy blobs.
+	LegacyEvents int
+	// Records is the number of those events found in the new layout after the
+	// migration. Migrate fails unless it is LegacyEvents less Duplicates.
+	Records int
+	// Duplicates is the number of events dropped because an event with the
+	// same audit ID and stage was already read or stored.
+	Duplicates int
+}
+
+// ErrMigrationStopped is returned by Migrate when it is stopped before the
+// store is fully migrated. The migration resumes where it stopped when run
+// again.
+var ErrMigrationStopped = fmt.Errorf("audit store migration was stopped")
+
+// MigrateOptions configure a Migrate run.
+type MigrateOptions struct {
+	// RedactionRules are the redaction rules of the receiver, which are applied
+	// to the records stored before bodies were redacted along with the
+	// built-in Secret rules.
+	RedactionRules []string
+	// Stop interrupts the migration between two store updates when closed.
+	Stop <-chan struct{}
+}
+
+type migration struct {
+	version int
+	name    string
+	run     func(m *migrator) error
+}
+
+// migrator holds the state of a Migrate run.
+type migrator struct {
+	s    *Store
+	res  *MigrationResult
+	stop <-chan struct{}
+	// redactor redacts the stored bodies.
+	redactor *redactor
+}
+
+// stopped returns ErrMigrationStopped once the migration is stopped. Steps
+// check it before each store update.
+func (m *migrator) stopped() error {
+	select {
+	case <-m.stop:
+		return ErrMigrationStopped
+	default:
+		return nil
+	}
+}
+
+// migrations upgrade the store one schema version at a time.
+var migrations = []migration{
+	{version: 2, name: "split legacy commit blobs into per-event records", run: migrateLegacyBlobs},
+	{version: 3, name: "index events by audit ID and stage", run: migrateDedupIndex},
+	{version: 4, name: "store events as records indexed by correlation key", run: migrateRecords},
+	{version: 5, name: "index correlations by object", run: migrateObjectIndex},
+	{version: 6, name: "index correlations by object UID", run: migrateUIDIndex},
+	{version: 7, name: "merge stages into requests", run: migrateRequests},
+	{version: 8, name: "redact stored bodies", run: migrateRedaction},
+}
+
+// Schema versions 2 and 3 stored events per commit of the legacy
+// git-commit-hash annotation:
+//
+//	commit/<hash>/<stageTimestamp>/<auditID>/<stage>
+const legacyCommitPrefix = "commit/"
+
+func legacyEventKey(hash string, ev *v1beta1.Event) []byte {
+	return []byte(legacyCommitPrefix + url.PathEscape(hash) + "/" + eventID(ev))
+}
+
+func parseLegacyEventKey(key []byte) (string, bool) {
+	s := strings.TrimPrefix(string(key), legacyCommitPrefix)
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return "", false
+	}
+	hash, err := url.PathUnescape(s[:i])
+	if err != nil {
+		return "", false
+	}
+	return hash, true
+}
+
+// migrationChunkSize is the number of records rewritten by one store update,
+// which keeps online migrations from holding the writer lock for long.
+const migrationChunkSize = 500
+
+// SchemaVersion returns the schema version of the store. Stores written before
+// the version marker was introduced are version 1 if they hold legacy keys.
+func (s *Store) SchemaVersion() (int, error) {
+	version, _, err := s.schemaVersion()
+	return version, err
+}
+
+// schemaVersion returns the schema version of the store and whether it is
+// recorded by the version marker.
+func (s *Store) schemaVersion() (int, bool, error) {
+	version, marked := 0, false
+	err := s.View(func(r leveldb.Reader) error {
+		data, err := r.Get([]byte(schemaVersionKey), nil)
+		if err == nil {
+			marked = true
+			version, err = strconv.Atoi(string(data))
+			if err != nil {
+				return fmt.Errorf("invalid audit schema version %q: %v", data, err)
+			}
+			return nil
+		}
+		if err != leveldb.ErrNotFound {
+			return err
+		}
+
+		version = SchemaVersion
+		iter := r.NewIterator(nil, nil)
+		defer iter.Release()
+		for iter.Next() {
+			if isLegacyKey(iter.Key()) {
+				version = 1
+				break
+			}
+		}
+		return iter.Error()
+	})
+	return version, marked, err
+}
+
+func (s *Store) setSchemaVersion(version int) error {
+	return s.Update(func(_ leveldb.Reader, b *leveldb.Batch) error {
+		b.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(version)))
+		return nil
+	})
+}
+
+// Migrate upgrades the store to SchemaVersion. It runs against a live store:
+// each step commits small atomic updates and may be interrupted and run again
+// at any point, without losing or duplicating records.
+func Migrate(s *Store, opts MigrateOptions) (*MigrationResult, error) {
+	from, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	res := &MigrationResult{FromVersion: from, ToVersion: from}
+	redactor, err := newRedactor(opts.RedactionRules)
+	if err != nil {
+		return res, err
+	}
+	m := &migrator{s: s, res: res, stop: opts.Stop, redactor: redactor}
+	if from > SchemaVersion {
+		return res, fmt.Errorf("audit schema version %d is newer than supported version %d", from, SchemaVersion)
+	}
+
+	for _, step := range migrations {
+		if step.version <= from {
+			continue
+		}
+		glog.Infof("Migrating audit store to schema version %d: %s", step.version, step.name)
+		if err := step.run(m); err == ErrMigrationStopped {
+			return res, err
+		} else if err != nil {
+			return res, fmt.Errorf("migration to schema version %d failed: %v", step.version, err)
+		}
+		if err := s.setSchemaVersion(step.version); err != nil {
+			return res, err
+		}
+		res.ToVersion = step.version
+	}
+	if err := m.verifyLegacyEvents(); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// legacyCounts are the legacy blobs and events read by every run of the
+// migration of legacy blobs, see legacyCountsKey.
+type legacyCounts struct {
+	Commits    int `json:"commits"`
+	Events     int `json:"events"`
+	Duplicates int `json:"duplicates"`
+}
+
+// getLegacyCounts returns the recorded legacy counts, or nil if no legacy blob
+// was migrated.
+func getLegacyCounts(r leveldb.Reader) (*legacyCounts, error) {
+	data, err := r.Get([]byte(legacyCountsKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c := &legacyCounts{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid legacy migration counts %q: %v", data, err)
+	}
+	return c, nil
+}
+
+// verifyLegacyEvents checks that every distinct event read from legacy blobs,
+// by this run or by the runs it resumes, is stored as a record. Once they are
+// verified, the recorded legacy events and counts are dropped.
+func (m *migrator) verifyLegacyEvents() error {
+	var counts *legacyCounts
+	found := 0
+	err := m.s.View(func(r leveldb.Reader) error {
+		var err error
+		if counts, err = getLegacyCounts(r); err != nil || counts == nil {
+			return err
+		}
+		iter := r.NewIterator(util.BytesPrefix([]byte(legacyEventPrefix)), nil)
+		defer iter.Release()
+		for iter.Next() {
+			key, err := r.Get(iter.Key()[len(legacyEventPrefix):], nil)
+			if err == leveldb.ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if _, err := r.Get(key, nil); err == nil {
+				found++
+			} else if err != leveldb.ErrNotFound {
+				return err
+			}
+		}
+		return iter.Error()
+	})
+	if err != nil || counts == nil {
+		return err
+	}
+	m.res.Records = found
+	if expected := counts.Events - counts.Duplicates; found != expected {
+		return fmt.Errorf("found %d migrated records, expected %d legacy events less %d duplicates", found, counts.Events, counts.Duplicates)
+	}
+
+	err = m.forEach(legacyEventPrefix, func(txn *writeTxn, key, _ []byte) error {
+		txn.delete(key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return m.s.Update(func(_ leveldb.Reader, b *leveldb.Batch) error {
+		b.Delete([]byte(legacyCountsKey))
+		return nil
+	})
+}
+
+func migrateLegacyBlobs(m *migrator) error {
+	var legacy []string
+	err := m.s.View(func(r leveldb.Reader) error {
+		iter := r.NewIterator(nil, nil)
+		defer iter.Release()
+		for iter.Next() {
+			if isLegacyKey(iter.Key()) {
+				legacy = append(legacy, string(iter.Key()))
+			}
+		}
+		return iter.Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range legacy {
+		if err := m.stopped(); err != nil {
+			return err
+		}
+		if err := migrateLegacyBlob(m, hash); err != nil {
+			return fmt.Errorf("commit %s: %v", hash, err)
+		}
+	}
+	return nil
+}
+
+// migrateLegacyBlob rewrites the events of one commit and drops the legacy
+// blob in the same update. The events are recorded and counted, and the
+// repeated ones counted as duplicates, for verifyLegacyEvents.
+func migrateLegacyBlob(m *migrator, hash string) error {
+	return m.s.Update(func(r leveldb.Reader, b *leveldb.Batch) error {
+		txn := newWriteTxn(r, b)
+		data, err := r.Get([]byte(hash), nil)
+		if err == leveldb.ErrNotFound {
+			// already migrated by an earlier run
+			return nil
+		} else if err != nil {
+			return err
+		}
+		list := &v1beta1.EventList{}
+		if err := json.Unmarshal(data, list); err != nil {
+			return err
+		}
+		counts, err := getLegacyCounts(r)
+		if err != nil {
+			return err
+		}
+		if counts == nil {
+			counts = &legacyCounts{}
+		}
+		duplicates := 0
+		for i := range list.Items {
+			ev := &list.Items[i]
+			value, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			txn.put(legacyEventKey(hash, ev), value)
+
+			key := legacyEventMetaKey(dedupKey(ev))
+			if _, err := txn.get(key); err == nil {
+				duplicates++
+			} else if err != leveldb.ErrNotFound {
+				return err
+			}
+			txn.put(key, nil)
+		}
+		txn.delete([]byte(hash))
+
+		counts.Commits++
+		counts.Events += len(list.Items)
+		counts.Duplicates += duplicates
+		data, err = json.Marshal(counts)
+		if err != nil {
+			return err
+		}
+		txn.put([]byte(legacyCountsKey), data)
+
+		m.res.Commits++
+		m.res.LegacyEvents += len(list.Items)
+		m.res.Duplicates += duplicates
+		return nil
+	})
+}
+
+// migrateDedupIndex indexes every stored event by audit ID and stage. Of
+// events stored more than once, the first one in key order is kept.
+func migrateDedupIndex(m *migrator) error {
+	s, res := m.s, m.res
+	type indexEntry struct {
+		key []byte
+		dk  []byte
+	}
+
+	start := []byte(legacyCommitPrefix)
+	limit := util.BytesPrefix([]byte(legacyCommitPrefix)).Limit
+	for {
+		var chunk []indexEntry
+		err := s.View(func(r leveldb.Reader) error {
+			iter := r.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+			defer iter.Release()
+			for len(chunk) < migrationChunkSize && iter.Next() {
+				ev := &v1beta1.Event{}
+				if err := json.Unmarshal(iter.Value(), ev); err != nil {
+					return fmt.Errorf("failed to unmarshal event %s: %v", iter.Key(), err)
+				}
+				key := append([]byte(nil), iter.Key()...)
+				chunk = append(chunk, indexEntry{key: key, dk: dedupKey(ev)})
+			}
+			return iter.Error()
+		})
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := m.stopped(); err != nil {
+			return err
+		}
+
+		err = s.Update(func(db leveldb.Reader, b *leveldb.Batch) error {
+			txn := newWriteTxn(db, b)
+			for _, e := range chunk {
+				existing, err := txn.get(e.dk)
+				if err == leveldb.ErrNotFound {
+					txn.put(e.dk, e.key)
+					continue
+				} else if err != nil {
+					return err
+				}
+				if !bytes.Equal(existing, e.key) {
+					b.Delete(e.key)
+					// duplicates read from legacy blobs are already counted
+					if _, err := txn.get(legacyEventMetaKey(e.dk)); err == leveldb.ErrNotFound {
+						res.Duplicates++
+					} else if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		start = append(chunk[len(chunk)-1].key, 0)
+	}
+}
+
+// migrateRecords moves the events of the legacy commit layout to Records
+// correlated by the git-commit-hash annotation. Moved events are deleted, so
+// each chunk starts over at the beginning of the legacy layout.
+func migrateRecords(m *migrator) error {
+	for {
+		if err := m.stopped(); err != nil {
+			return err
+		}
+		moved := 0
+		err := m.s.Update(func(db leveldb.Reader, b *leveldb.Batch) error {
+			iter := db.NewIterator(util.BytesPrefix([]byte(legacyCommitPrefix)), nil)
+			defer iter.Release()
+			for moved < migrationChunkSize && iter.Next() {
+				hash, ok := parseLegacyEventKey(iter.Key())
+				if !ok {
+					return fmt.Errorf("invalid legacy event key %s", iter.Key())
+				}
+				rec := Record{
+					Correlations: []Correlation{{Source: SourceAnnotation, Key: DefaultCorrelationKey, Value: hash}},
+				}
+				if err := json.Unmarshal(iter.Value(), &rec.Event); err != nil {
+					return fmt.Errorf("failed to unmarshal event %s: %v", iter.Key(), err)
+				}
+				data, err := json.Marshal(&rec)
+				if err != nil {
+					return err
+				}
+				key := eventKey(&rec.Event)
+				b.Put(key, data)
+				b.Put(indexKey(rec.Correlations[0], &rec.Event), nil)
+				b.Put(dedupKey(&rec.Event), key)
+				b.Delete(iter.Key())
+				moved++
+			}
+			return iter.Error()
+		})
+		if err != nil {
+			return err
+		}
+		if moved == 0 {
+			return nil
+		}
+	}
+}
+
+// migrateObjectIndex records the correlations of stored events by object.
+func migrateObjectIndex(m *migrator) error {
+	return m.reindexRecords(func(txn *writeTxn, rec *Record, cs []Correlation, respMeta, reqMeta *metav1.ObjectMeta) error {
+		if key := eventObjectKey(&rec.Event, respMeta, reqMeta); key != nil {
+			return txn.putObjectCorrelations(key, cs, false)
+		}
+		return nil
+	})
+}
+
+// migrateUIDIndex records the correlations of stored events by object UID.
+func migrateUIDIndex(m *migrator) error {
+	return m.reindexRecords(func(txn *writeTxn, rec *Record, cs []Correlation, respMeta, reqMeta *metav1.ObjectMeta) error {
+		if key := eventUIDKey(&rec.Event, respMeta, reqMeta); key != nil {
+			return txn.putObjectCorrelations(key, cs, false)
+		}
+		return nil
+	})
+}
+
+// migrateRequests merges every stored record into the request of its audit
+// ID. Merging is idempotent, so records merged by an earlier run or during
+// ingestion are left as they are.
+func migrateRequests(m *migrator) error {
+	return m.forEachRecord(func(txn *writeTxn, rec *Record) error {
+		return txn.mergeRequest(rec)
+	})
+}
+
+// migrateRedaction redacts the bodies of the records and requests stored
+// before ingestion redacted them, with the built-in and configured redaction
+// rules. Rules configured later only apply to events stored from then on.
+func migrateRedaction(m *migrator) error {
+	err := m.forEach(eventPrefix, func(txn *writeTxn, key, value []byte) error {
+		rec := &Record{}
+		if err := json.Unmarshal(value, rec); err != nil {
+			return fmt.Errorf("failed to unmarshal record %s: %v", key, err)
+		}
+		if !m.redact(rec) {
+			return nil
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		txn.put(key, data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return m.forEach(requestPrefix, func(txn *writeTxn, key, value []byte) error {
+		q := &Request{}
+		if err := json.Unmarshal(value, q); err != nil {
+			return fmt.Errorf("failed to unmarshal request %s: %v", key, err)
+		}
+		if !m.redact(&q.Record) {
+			return nil
+		}
+		data, err := json.Marshal(q)
+		if err != nil {
+			return err
+		}
+		txn.put(key, data)
+		return nil
+	})
+}
+
+// redact redacts the bodies of rec and reports whether any value was
+// redacted.
+func (m *migrator) redact(rec *Record) bool {
+	redacted := rec.Redacted
+	rec.Redacted = false
+	m.redactor.redact(rec)
+	if !rec.Redacted {
+		rec.Redacted = redacted
+		return false
+	}
+	return true
+}
+
+// reindexRecords calls fn with every stored record with correlations of its
+// own, and the metadata of its bodies. The records are visited in stage
+// timestamp order, so the last event on an object wins as it does during
+// ingestion.
+func (m *migrator) reindexRecords(fn func(txn *writeTxn, rec *Record, cs []Correlation, respMeta, reqMeta *metav1.ObjectMeta) error) error {
+	return m.forEachRecord(func(txn *writeTxn, rec *Record) error {
+		var direct []Correlation
+		for _, c := range rec.Correlations {
+			if c.From != FromObjectRef && c.From != FromObjectUID && c.From != FromOwnerReference {
+				direct = append(direct, c)
+			}
+		}
+		if len(direct) == 0 {
+			return nil
+		}
+		respMeta, _ := bodyMeta(rec.Event.ResponseObject)
+		reqMeta, _ := bodyMeta(rec.Event.RequestObject)
+		return fn(txn, rec, direct, respMeta, reqMeta)
+	})
+}
+
+// forEachRecord calls fn with every stored record in stage timestamp order,
+// a chunk of records per store update.
+func (m *migrator) forEachRecord(fn func(txn *writeTxn, rec *Record) error) error {
+	return m.forEach(eventPrefix, func(txn *writeTxn, key, value []byte) error {
+		rec := &Record{}
+		if err := json.Unmarshal(value, rec); err != nil {
+			return fmt.Errorf("failed to unmarshal record %s: %v", key, err)
+		}
+		return fn(txn, rec)
+	})
+}
+
+// forEach calls fn with every key and value under prefix in key order, a
+// chunk of keys per store update.
+func (m *migrator) forEach(prefix string, fn func(txn *writeTxn, key, value []byte) error) error {
+	start := []byte(prefix)
+	limit := util.BytesPrefix([]byte(prefix)).Limit
+	for {
+		if err := m.stopped(); err != nil {
+			return err
+		}
+		var last []byte
+		err := m.s.Update(func(db leveldb.Reader, b *leveldb.Batch) error {
+			txn := newWriteTxn(db, b)
+			iter := db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+			defer iter.Release()
+			for n := 0; n < migrationChunkSize && iter.Next(); n++ {
+				last = append(last[:0], iter.Key()...)
+				if err := fn(txn, iter.Key(), iter.Value()); err != nil {
+					return err
+				}
+			}
+			return iter.Error()
+		})
+		if err != nil {
+			return err
+		}
+		if last == nil {
+			return nil
+		}
+		start = append(last, 0)
+	}
+}
@@ -0,0 +1,269 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestMigrateLegacyBlobs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	legacy := &v1beta1.EventList{
+		Items: []v1beta1.Event{
+			newEvent("a", v1beta1.StageResponseComplete, now, "abc"),
+			newEvent("b", v1beta1.StageResponseComplete, now.Add(time.Second), "abc"),
+			// retried batches used to be appended twice
+			newEvent("b", v1beta1.StageResponseComplete, now.Add(time.Second), "abc"),
+		},
+	}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("abc"), data, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.SchemaVersion(); err != nil || v != 1 {
+		t.Fatalf("expected schema version 1, got %d, %v", v, err)
+	}
+	// the legacy store is marked before it is migrated
+	err = s.View(func(r leveldb.Reader) error {
+		if v, err := r.Get([]byte(schemaVersionKey), nil); err != nil || string(v) != "1" {
+			t.Errorf("expected schema version marker 1, got %q, %v", v, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stopped migration leaves the store as it is, to be resumed later
+	stop := make(chan struct{})
+	close(stop)
+	if res, err := Migrate(s, MigrateOptions{Stop: stop}); err != ErrMigrationStopped || res.ToVersion != 1 {
+		t.Fatalf("expected the migration to stop at schema version 1, got %+v, %v", res, err)
+	}
+
+	res, err := Migrate(s, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FromVersion != 1 || res.ToVersion != SchemaVersion || res.Commits != 1 || res.LegacyEvents != 3 || res.Records != 2 {
+		t.Errorf("unexpected migration result %+v", res)
+	}
+
+	events, err := storedRecords(s, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Event.AuditID != "a" || events[1].Event.AuditID != "b" {
+		t.Errorf("expected events a and b, got %+v", events)
+	}
+	err = s.View(func(r leveldb.Reader) error {
+		if _, err := r.Get([]byte("abc"), nil); err != leveldb.ErrNotFound {
+			t.Errorf("expected legacy blob to be removed, got %v", err)
+		}
+		for i := range events {
+			if _, err := r.Get(dedupKey(&events[i].Event), nil); err != nil {
+				t.Errorf("expected event %s to be indexed, got %v", events[i].Event.AuditID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// running again is a no-op
+	res, err = Migrate(s, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FromVersion != SchemaVersion || res.Commits != 0 {
+		t.Errorf("expected no-op migration, got %+v", res)
+	}
+
+	// a legacy event missing from the new layout fails the verification
+	missing := newEvent("c", v1beta1.StageResponseComplete, now, "abc")
+	err = s.Update(func(_ leveldb.Reader, b *leveldb.Batch) error {
+		b.Put([]byte(legacyCountsKey), []byte(`{"commits":1,"events":1,"duplicates":0}`))
+		b.Put(legacyEventMetaKey(dedupKey(&missing)), nil)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &migrator{s: s, res: &MigrationResult{}}
+	if err := m.verifyLegacyEvents(); err == nil {
+		t.Errorf("expected a missing event to fail the verification")
+	}
+}
+
+func TestMigrateLegacyBlobsResumed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	db, err := openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash, ids := range map[string][]string{"abc": {"a", "b"}, "def": {"c"}} {
+		legacy := &v1beta1.EventList{}
+		for _, id := range ids {
+			legacy.Items = append(legacy.Items, newEvent(id, v1beta1.StageResponseComplete, now, hash))
+		}
+		data, err := json.Marshal(legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte(hash), data, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	s, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a run stopped after migrating the first blob
+	first := &migrator{s: s, res: &MigrationResult{}}
+	if err := migrateLegacyBlob(first, "abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the resumed run verifies the events of both runs
+	res, err := Migrate(s, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Commits != 1 || res.LegacyEvents != 1 || res.Records != 3 {
+		t.Errorf("unexpected migration result %+v", res)
+	}
+	err = s.View(func(r leveldb.Reader) error {
+		if _, err := r.Get([]byte(legacyCountsKey), nil); err != leveldb.ErrNotFound {
+			t.Errorf("expected the legacy counts to be dropped once verified, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateDedupIndexRemovesDuplicates(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// a version 2 store holding a retried event with a different timestamp
+	now := time.Now()
+	db, err := openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range []v1beta1.Event{
+		newEvent("a", v1beta1.StageResponseComplete, now, "abc"),
+		newEvent("a", v1beta1.StageResponseComplete, now.Add(time.Millisecond), "abc"),
+		newEvent("b", v1beta1.StageResponseComplete, now, "abc"),
+	} {
+		data, err := json.Marshal(&ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put(legacyEventKey("abc", &ev), data, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte(schemaVersionKey), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	res, err := Migrate(s, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FromVersion != 2 || res.ToVersion != SchemaVersion || res.Duplicates != 1 {
+		t.Errorf("unexpected migration result %+v", res)
+	}
+	events, err := storedRecords(s, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("expected 2 events, got %d", len(events))
+	}
+}
+
+func TestMigrateRedactsStoredBodies(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// a legacy blob stored before bodies were redacted
+	ev := newObjectEvent("a", v1beta1.StageResponseComplete, time.Now(),
+		`{"kind":"Secret","apiVersion":"v1","metadata":{"name":"foo","annotations":{"git-commit-hash":"abc"}},"data":{"password":"c2VjcmV0"}}`)
+	ev.ObjectRef = &v1beta1.ObjectReference{Resource: "secrets", Namespace: "prod", Name: "foo"}
+	data, err := json.Marshal(&v1beta1.EventList{Items: []v1beta1.Event{ev}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("abc"), data, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := Migrate(s, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = `{"apiVersion":"v1","data":{"password":"REDACTED"},"kind":"Secret","metadata":{"annotations":{"git-commit-hash":"abc"},"name":"foo"}}`
+	records, err := storedRecords(s, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].Redacted || string(records[0].Event.ResponseObject.Raw) != expected {
+		t.Errorf("expected a redacted record, got %+v", records)
+	}
+	requests, err := storedRequests(s, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || !requests[0].Redacted || string(requests[0].Event.ResponseObject.Raw) != expected {
+		t.Errorf("expected a redacted request, got %+v", requests)
+	}
+}
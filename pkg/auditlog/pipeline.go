@@ -0,0 +1,167 @@
+package auditlog
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+var (
+	// ErrQueueFull is returned when the ingest queue has no room for a batch.
+	ErrQueueFull = fmt.Errorf("audit ingest queue is full")
+	// ErrPipelineStopped is returned for batches submitted after shutdown.
+	ErrPipelineStopped = fmt.Errorf("audit ingest pipeline is stopped")
+)
+
+type ingestJob struct {
+	list *v1beta1.EventList
+	done chan error
+}
+
+// pipeline stores event batches with a fixed number of workers reading from a
+// bounded queue. Each worker drains up to maxBatch queued jobs and commits
+// them with a single store write, so bursts cost fewer disk syncs.
+//
+// A batch takes a slot before its request body is read and keeps it until it
+// is stored, which bounds the batches held in memory to the queue size plus
+// one per worker.
+type pipeline struct {
+	r        *Receiver
+	queue    chan *ingestJob
+	slots    chan struct{}
+	maxBatch int
+
+	// mu guards stopped against submissions racing with stop.
+	mu      sync.RWMutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newPipeline(r *Receiver, workers, queueSize, maxBatch int) *pipeline {
+	p := &pipeline{
+		r:        r,
+		queue:    make(chan *ingestJob, queueSize),
+		slots:    make(chan struct{}, queueSize+workers),
+		maxBatch: maxBatch,
+	}
+	queueCapacity.Set(float64(queueSize))
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// reserve takes a slot for a batch about to be read. It fails fast with
+// ErrQueueFull instead of blocking when every slot is taken. The slot is
+// returned by release if the batch is not submitted.
+func (p *pipeline) reserve() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return ErrPipelineStopped
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+		rejectedCounter.Inc()
+		return ErrQueueFull
+	}
+}
+
+// release returns a slot taken by reserve.
+func (p *pipeline) release() {
+	<-p.slots
+}
+
+// submit queues list, for which a slot was reserved, and waits until it is
+// stored. The slot is returned once the batch is stored or rejected.
+func (p *pipeline) submit(list *v1beta1.EventList) error {
+	job := &ingestJob{list: list, done: make(chan error, 1)}
+
+	p.mu.RLock()
+	if p.stopped {
+		p.mu.RUnlock()
+		p.release()
+		return ErrPipelineStopped
+	}
+	select {
+	case p.queue <- job:
+		queueDepth.Set(float64(len(p.queue)))
+		p.mu.RUnlock()
+	default:
+		p.mu.RUnlock()
+		p.release()
+		rejectedCounter.Inc()
+		return ErrQueueFull
+	}
+	return <-job.done
+}
+
+// depth returns the number of queued batches.
+func (p *pipeline) depth() int {
+	return len(p.queue)
+}
+
+// stop rejects new batches and waits for the queued ones to be stored.
+func (p *pipeline) stop() {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *pipeline) work() {
+	defer p.wg.Done()
+	for job := range p.queue {
+		jobs := []*ingestJob{job}
+	drain:
+		for len(jobs) < p.maxBatch {
+			select {
+			case next, ok := <-p.queue:
+				if !ok {
+					break drain
+				}
+				jobs = append(jobs, next)
+			default:
+				break drain
+			}
+		}
+		queueDepth.Set(float64(len(p.queue)))
+		p.store(jobs)
+		for range jobs {
+			p.release()
+		}
+	}
+}
+
+// store commits the events of jobs in one write. A job whose events can not
+// be converted fails alone; a failed write fails every job of the write.
+func (p *pipeline) store(jobs []*ingestJob) {
+	var events []*ingestEvent
+	var pending []*ingestJob
+	for _, job := range jobs {
+		evs, err := p.r.extract(job.list)
+		if err != nil {
+			job.done <- err
+			continue
+		}
+		events = append(events, evs...)
+		pending = append(pending, job)
+	}
+
+	writeBatchSize.Observe(float64(len(pending)))
+	err := p.r.storeEvents(events)
+	if err != nil {
+		glog.Errorf("Failed to store %d event batches: %v", len(pending), err)
+	}
+	for _, job := range pending {
+		job.done <- err
+	}
+}
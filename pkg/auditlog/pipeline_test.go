@@ -0,0 +1,95 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestPipelineBackpressure(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	// a pipeline without workers fills up after one batch
+	r.pipeline.stop()
+	r.pipeline = newPipeline(r, 0, 1, 4)
+
+	queued := &ingestJob{
+		list: &v1beta1.EventList{Items: []v1beta1.Event{newEvent("a", v1beta1.StageResponseComplete, time.Now(), "abc")}},
+		done: make(chan error, 1),
+	}
+	if err := r.pipeline.reserve(); err != nil {
+		t.Fatal(err)
+	}
+	r.pipeline.queue <- queued
+	if r.QueueDepth() != 1 {
+		t.Errorf("expected queue depth 1, got %d", r.QueueDepth())
+	}
+
+	data, err := json.Marshal(&v1beta1.EventList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the body of a rejected batch is not read
+	body := bytes.NewReader(data)
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/events", body))
+	if body.Len() != len(data) {
+		t.Errorf("expected the body of a rejected batch to be left unread")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+
+	r.pipeline.wg.Add(1)
+	go r.pipeline.work()
+	if err := <-queued.done; err != nil {
+		t.Fatal(err)
+	}
+	if events, err := storedRecords(r.store, commit("abc")); err != nil || len(events) != 1 {
+		t.Errorf("expected queued event to be stored, got %d, %v", len(events), err)
+	}
+}
+
+func TestPipelineConcurrentSubmit(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	const n = 40
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			list := &v1beta1.EventList{
+				Items: []v1beta1.Event{newEvent(string(rune('A'+i)), v1beta1.StageResponseComplete, now, "abc")},
+			}
+			if err := r.pipeline.reserve(); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := r.pipeline.submit(list); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	events, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != n {
+		t.Errorf("expected %d events, got %d", n, len(events))
+	}
+}
@@ -0,0 +1,160 @@
+package auditlog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/apis/audit/v1alpha1"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+	"k8s.io/apiserver/pkg/apis/audit/validation"
+	"k8s.io/apiserver/pkg/audit/policy"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// policyFilter applies an audit Policy of the receiver to the events it
+// receives, on top of the policy of the apiserver. The policy file is polled
+// and reloaded when it changes. A policy that fails to load is reported and
+// the previous one is kept.
+type policyFilter struct {
+	path string
+
+	mu      sync.RWMutex
+	checker policy.Checker
+	// data is the content of the policy file checker was loaded from.
+	data []byte
+}
+
+func newPolicyFilter(path string) (*policyFilter, error) {
+	f := &policyFilter{path: path}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload loads the policy file if it changed since it was last loaded, and
+// reports whether it did.
+func (f *policyFilter) reload() (bool, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	f.mu.RLock()
+	unchanged := f.checker != nil && bytes.Equal(data, f.data)
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	p, err := decodePolicy(data)
+	if err != nil {
+		return false, fmt.Errorf("invalid audit policy %s: %v", f.path, err)
+	}
+	f.mu.Lock()
+	f.checker, f.data = policy.NewChecker(p), data
+	f.mu.Unlock()
+	return true, nil
+}
+
+// decodePolicy decodes and validates a v1alpha1, v1beta1 or v1 Policy. The
+// vendored policy.LoadPolicyFromFile decodes with a scheme that lacks the
+// internal audit types and always returns a Policy without rules, so the
+// policy is decoded with the receiver's Scheme instead.
+func decodePolicy(data []byte) (*audit.Policy, error) {
+	p := &audit.Policy{}
+	decoder := Codecs.UniversalDecoder(auditV1, v1beta1.SchemeGroupVersion, v1alpha1.SchemeGroupVersion)
+	if _, _, err := decoder.Decode(data, nil, p); err != nil {
+		return nil, err
+	}
+	if errs := validation.ValidatePolicy(p); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+	if len(p.Rules) == 0 {
+		return nil, fmt.Errorf("policy has no rules")
+	}
+	return p, nil
+}
+
+// run reloads the policy file every interval until stopCh is closed.
+func (f *policyFilter) run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		if reloaded, err := f.reload(); err != nil {
+			glog.Errorf("Failed to reload audit policy %s, keeping the previous policy: %v", f.path, err)
+		} else if reloaded {
+			glog.Infof("Reloaded audit policy %s", f.path)
+		}
+	}
+}
+
+// level returns the level ev is stored at, which is never higher than the
+// level it was recorded at, and false if ev is not stored at all.
+func (f *policyFilter) level(ev *v1beta1.Event) (v1beta1.Level, bool) {
+	f.mu.RLock()
+	checker := f.checker
+	f.mu.RUnlock()
+
+	level, omitStages := checker.LevelAndStages(eventAttributes(ev))
+	if level == audit.LevelNone {
+		return "", false
+	}
+	for _, stage := range omitStages {
+		if string(stage) == string(ev.Stage) {
+			return "", false
+		}
+	}
+	if recorded := audit.Level(ev.Level); recorded != "" && recorded.Less(level) {
+		level = recorded
+	}
+	return v1beta1.Level(level), true
+}
+
+// eventAttributes returns the request attributes of ev the policy rules are
+// matched against.
+func eventAttributes(ev *v1beta1.Event) authorizer.Attributes {
+	attrs := authorizer.AttributesRecord{
+		User: &user.DefaultInfo{
+			Name:   ev.User.Username,
+			UID:    ev.User.UID,
+			Groups: ev.User.Groups,
+		},
+		Verb: ev.Verb,
+	}
+	if ref := ev.ObjectRef; ref != nil {
+		attrs.ResourceRequest = true
+		attrs.Namespace = ref.Namespace
+		attrs.Name = ref.Name
+		attrs.APIGroup = ref.APIGroup
+		attrs.APIVersion = ref.APIVersion
+		attrs.Resource = ref.Resource
+		attrs.Subresource = ref.Subresource
+	} else if u, err := url.ParseRequestURI(ev.RequestURI); err == nil {
+		attrs.Path = u.Path
+	}
+	return attrs
+}
+
+// applyLevel downgrades rec to level, dropping the bodies the level does not
+// record.
+func applyLevel(rec *Record, level v1beta1.Level) {
+	rec.Event.Level = level
+	if level != v1beta1.LevelRequest && level != v1beta1.LevelRequestResponse {
+		rec.Event.RequestObject, rec.OpaqueRequestObject = nil, nil
+	}
+	if level != v1beta1.LevelRequestResponse {
+		rec.Event.ResponseObject, rec.OpaqueResponseObject = nil, nil
+	}
+}
@@ -0,0 +1,131 @@
+package auditlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestPolicyFilter(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.yaml")
+	writePolicy := func(policy string) {
+		if err := ioutil.WriteFile(policyFile, []byte(policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePolicy(`apiVersion: audit.k8s.io/v1beta1
+kind: Policy
+omitStages: ["RequestReceived"]
+rules:
+- level: None
+  resources:
+  - group: ""
+    resources: ["secrets"]
+- level: Metadata
+  resources:
+  - group: "apps"
+    resources: ["deployments"]
+- level: RequestResponse
+`)
+
+	opts := NewOptions()
+	opts.DataDir = filepath.Join(dir, "data")
+	opts.PolicyFile = policyFile
+	r := NewReceiver(*opts)
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	now := time.Now()
+	event := func(id string, stage v1beta1.Stage, ts time.Time, group, resource string) v1beta1.Event {
+		ev := newEvent(id, stage, ts, "abc")
+		ev.Level = v1beta1.LevelRequestResponse
+		ev.ObjectRef = &v1beta1.ObjectReference{APIGroup: group, Resource: resource, Namespace: "prod", Name: id}
+		return ev
+	}
+	list := &v1beta1.EventList{Items: []v1beta1.Event{
+		event("a", v1beta1.StageResponseComplete, now, "apps", "deployments"),
+		event("b", v1beta1.StageRequestReceived, now.Add(time.Second), "", "configmaps"),
+		event("c", v1beta1.StageResponseComplete, now.Add(2*time.Second), "", "configmaps"),
+		event("d", v1beta1.StageResponseComplete, now.Add(3*time.Second), "", "secrets"),
+	}}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	writePolicy(`apiVersion: audit.k8s.io/v1beta1
+kind: Policy
+rules:
+- level: Request
+`)
+	if reloaded, err := r.policy.reload(); err != nil || !reloaded {
+		t.Fatalf("expected the policy to be reloaded, got %v, %v", reloaded, err)
+	}
+	if reloaded, err := r.policy.reload(); err != nil || reloaded {
+		t.Fatalf("expected an unchanged policy to be kept, got %v, %v", reloaded, err)
+	}
+	writePolicy("not a policy")
+	if _, err := r.policy.reload(); err == nil {
+		t.Fatal("expected an error for an invalid policy")
+	}
+
+	list = &v1beta1.EventList{Items: []v1beta1.Event{
+		event("e", v1beta1.StageResponseComplete, now.Add(4*time.Second), "", "secrets"),
+	}}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		id       string
+		level    v1beta1.Level
+		response bool
+	}{
+		{"a", v1beta1.LevelMetadata, false},
+		{"c", v1beta1.LevelRequestResponse, true},
+		{"e", v1beta1.LevelRequest, false},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %+v", len(expected), records)
+	}
+	for i, e := range expected {
+		ev := records[i].Event
+		if string(ev.AuditID) != e.id || ev.Level != e.level || (ev.ResponseObject != nil) != e.response {
+			t.Errorf("expected event %s at level %s with response %v, got %s at level %s with response %v",
+				e.id, e.level, e.response, ev.AuditID, ev.Level, ev.ResponseObject != nil)
+		}
+	}
+}
+
+func TestDecodePolicy(t *testing.T) {
+	for _, version := range []string{"v1alpha1", "v1beta1", "v1"} {
+		p, err := decodePolicy([]byte(`apiVersion: audit.k8s.io/` + version + `
+kind: Policy
+rules:
+- level: Metadata
+  resources:
+  - group: ""
+    resources: ["secrets"]
+`))
+		if err != nil {
+			t.Errorf("%s: %v", version, err)
+			continue
+		}
+		if len(p.Rules) != 1 || p.Rules[0].Level != audit.LevelMetadata || len(p.Rules[0].Resources) != 1 {
+			t.Errorf("%s: unexpected policy %+v", version, p)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+// Query selects stored records by correlation key and by the attributes of
+// their events. Empty fields match every record.
+type Query struct {
+	// Source and Key are the correlation key records are selected by, and
+	// Value the value they carried for it, like a commit hash.
+	Source string
+	Key    string
+	Value  string
+
+	Namespace string
+	Resource  string
+	Name      string
+	Verb      string
+	// User is the name of the user that made the request, and Group a group
+	// the user belongs to.
+	User  string
+	Group string
+	// MinCode and MaxCode bound the response codes of the events, inclusive.
+	// Events without a response status match no code range.
+	MinCode int32
+	MaxCode int32
+	// Since and Until bound the stage timestamps of the events. Since is
+	// inclusive and Until exclusive.
+	Since time.Time
+	Until time.Time
+
+	// Limit is the maximum number of results of a page, or 0 for no limit.
+	Limit int64
+	// after is the event ID the page starts after, taken from a continue
+	// token.
+	after string
+}
+
+// parseQuery parses the query parameters of /get-logs. The correlation key is
+// chosen with the annotation or label parameter and defaults to key.
+//
+//	value=<value>
+//	namespace=<namespace>&resource=<resource>&name=<name>
+//	verb=<verb>
+//	user=<username>&group=<group>
+//	code=<code> or code=<min>-<max>
+//	since=<RFC 3339 time>&until=<RFC 3339 time>
+//	limit=<page size>&continue=<token>
+func parseQuery(params url.Values, key correlationKey) (*Query, error) {
+	switch {
+	case params.Get(SourceAnnotation) != "":
+		key = correlationKey{source: SourceAnnotation, key: params.Get(SourceAnnotation)}
+	case params.Get(SourceLabel) != "":
+		key = correlationKey{source: SourceLabel, key: params.Get(SourceLabel)}
+	}
+	if key.key == "" {
+		return nil, fmt.Errorf("no correlation key given")
+	}
+
+	q := &Query{
+		Source:    key.source,
+		Key:       key.key,
+		Value:     params.Get("value"),
+		Namespace: params.Get("namespace"),
+		Resource:  params.Get("resource"),
+		Name:      params.Get("name"),
+		Verb:      params.Get("verb"),
+		User:      params.Get("user"),
+		Group:     params.Get("group"),
+	}
+	if code := params.Get("code"); code != "" {
+		min, max := code, code
+		if i := strings.IndexByte(code, '-'); i >= 0 {
+			min, max = code[:i], code[i+1:]
+		}
+		minCode, err := strconv.ParseInt(min, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid code %q", code)
+		}
+		maxCode, err := strconv.ParseInt(max, 10, 32)
+		if err != nil || maxCode < minCode {
+			return nil, fmt.Errorf("invalid code %q", code)
+		}
+		q.MinCode, q.MaxCode = int32(minCode), int32(maxCode)
+	}
+	for _, t := range []struct {
+		param string
+		time  *time.Time
+	}{
+		{"since", &q.Since},
+		{"until", &q.Until},
+	} {
+		if s := params.Get(t.param); s != "" {
+			v, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", t.param, s, err)
+			}
+			*t.time = v
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit %q", limit)
+		}
+		q.Limit = n
+	}
+	if token := params.Get("continue"); token != "" {
+		after, err := decodeContinue(token)
+		if err != nil {
+			return nil, err
+		}
+		q.after = after
+	}
+	return q, nil
+}
+
+// matches reports whether ev matches the attributes of q, other than its
+// stage timestamp.
+func (q *Query) matches(ev *v1beta1.Event) bool {
+	if q.Namespace != "" || q.Resource != "" || q.Name != "" {
+		ref := ev.ObjectRef
+		if ref == nil ||
+			(q.Namespace != "" && ref.Namespace != q.Namespace) ||
+			(q.Resource != "" && ref.Resource != q.Resource) ||
+			(q.Name != "" && ref.Name != q.Name) {
+			return false
+		}
+	}
+	if q.Verb != "" && ev.Verb != q.Verb {
+		return false
+	}
+	if q.User != "" && ev.User.Username != q.User {
+		return false
+	}
+	if q.Group != "" {
+		member := false
+		for _, g := range ev.User.Groups {
+			if g == q.Group {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return false
+		}
+	}
+	if q.MinCode != 0 || q.MaxCode != 0 {
+		if ev.ResponseStatus == nil || ev.ResponseStatus.Code < q.MinCode || ev.ResponseStatus.Code > q.MaxCode {
+			return false
+		}
+	}
+	return true
+}
+
+// selects reports whether q selects rec, other than by its stage timestamp.
+func (q *Query) selects(rec *Record) bool {
+	if !q.matches(&rec.Event) {
+		return false
+	}
+	for _, c := range rec.Correlations {
+		if c.Source == q.Source && c.Key == q.Key && (q.Value == "" || c.Value == q.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyRange returns the range of the keys under prefix with a stage timestamp
+// between Since and Until, starting after the continue position of q.
+func (q *Query) keyRange(prefix []byte) *util.Range {
+	key := func(id string) []byte {
+		return append(append([]byte(nil), prefix...), id...)
+	}
+	rng := util.BytesPrefix(prefix)
+	if !q.Since.IsZero() {
+		rng.Start = key(q.Since.UTC().Format(keyTimeFormat))
+	}
+	if q.after != "" {
+		if start := key(q.after + "\x00"); bytes.Compare(start, rng.Start) > 0 {
+			rng.Start = start
+		}
+	}
+	if !q.Until.IsZero() {
+		rng.Limit = key(q.Until.UTC().Format(keyTimeFormat))
+	}
+	return rng
+}
+
+// scan calls fn with the records matching q and their event IDs, ordered by
+// stage timestamp. Records with a value are found through the index of the
+// correlation key, and all others by scanning every record in the time range.
+func (q *Query) scan(r leveldb.Reader, fn func(id string, rec *Record) error) error {
+	if q.Value != "" {
+		c := Correlation{Source: q.Source, Key: q.Key, Value: q.Value}
+		return scanIndexKeys(r, q.keyRange(indexKeyPrefix(c)), func(_ Correlation, key []byte) error {
+			rec, err := getRecord(r, key)
+			if err != nil {
+				return err
+			}
+			if !q.matches(&rec.Event) {
+				return nil
+			}
+			return fn(string(key[len(eventPrefix):]), rec)
+		})
+	}
+
+	iter := r.NewIterator(q.keyRange([]byte(eventPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		rec := &Record{}
+		if err := json.Unmarshal(iter.Value(), rec); err != nil {
+			return fmt.Errorf("failed to unmarshal record %s: %v", iter.Key(), err)
+		}
+		if !q.selects(rec) {
+			continue
+		}
+		if err := fn(string(iter.Key()[len(eventPrefix):]), rec); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// scanRequests calls fn with the requests with a stage matching q, ordered by
+// the stage timestamp of their first matching stage, and the event ID of that
+// stage. A request is skipped at its later matching stages, which keeps it
+// from being repeated on the next page.
+func (q *Query) scanRequests(r leveldb.Reader, fn func(id string, req *Request) error) error {
+	return q.scan(r, func(id string, rec *Record) error {
+		req, err := getRequest(r, requestKey(rec.Event.AuditID))
+		if err != nil {
+			return err
+		}
+		for _, s := range req.Stages {
+			if s.Stage == rec.Event.Stage {
+				continue
+			}
+			ev := rec.Event
+			ev.Stage = s.Stage
+			key, err := r.Get(dedupKey(&ev), nil)
+			if err != nil {
+				return fmt.Errorf("failed to get the %s stage of request %s: %v", s.Stage, ev.AuditID, err)
+			}
+			earlier := string(key[len(eventPrefix):])
+			if earlier >= id || (!q.Since.IsZero() && earlier < q.Since.UTC().Format(keyTimeFormat)) {
+				continue
+			}
+			stage, err := getRecord(r, key)
+			if err != nil {
+				return err
+			}
+			if q.selects(stage) {
+				return nil
+			}
+		}
+		return fn(id, req)
+	})
+}
+
+// errPageFull stops the scan of a page once it holds Limit results.
+var errPageFull = fmt.Errorf("page is full")
+
+// pager collects a page of query results.
+type pager struct {
+	limit int64
+	n     int64
+	last  string
+	more  bool
+}
+
+// add counts the result with the event ID id. It returns errPageFull instead
+// when the page already holds limit results.
+func (p *pager) add(id string) error {
+	if p.limit > 0 && p.n == p.limit {
+		p.more = true
+		return errPageFull
+	}
+	p.n++
+	p.last = id
+	return nil
+}
+
+// continueToken returns the continue token of the next page, or "" if the
+// page holds the last result.
+func (p *pager) continueToken() string {
+	if !p.more {
+		return ""
+	}
+	return encodeContinue(p.last)
+}
+
+// continueToken is the position of a page in the results of a query, like the
+// continue tokens of the apiserver. Its start is the event ID of the last
+// result of the previous page, which is shared by the event and index keys.
+type continueToken struct {
+	APIVersion string `json:"v"`
+	StartKey   string `json:"start"`
+}
+
+const continueVersion = "meta.k8s.io/v1"
+
+func encodeContinue(after string) string {
+	data, _ := json.Marshal(continueToken{APIVersion: continueVersion, StartKey: after})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeContinue(token string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid continue token: %v", err)
+	}
+	c := &continueToken{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return "", fmt.Errorf("invalid continue token: %v", err)
+	}
+	if c.APIVersion != continueVersion {
+		return "", fmt.Errorf("unsupported continue token version %q", c.APIVersion)
+	}
+	if _, ok := parseEventKeyAuditID([]byte(eventPrefix + c.StartKey)); !ok {
+		return "", fmt.Errorf("invalid continue token: invalid start key %q", c.StartKey)
+	}
+	return c.StartKey, nil
+}
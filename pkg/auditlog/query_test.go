@@ -0,0 +1,169 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestServeLogsQuery(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	t0 := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	event := func(auditID, hash string, ts time.Time, namespace, verb, user, group string, code int32) v1beta1.Event {
+		ev := newEvent(auditID, v1beta1.StageResponseComplete, ts, hash)
+		ev.ObjectRef = &v1beta1.ObjectReference{Namespace: namespace, Resource: "deployments", Name: "foo"}
+		ev.Verb = verb
+		ev.User = authnv1.UserInfo{Username: user, Groups: []string{group}}
+		if code != 0 {
+			ev.ResponseStatus = &metav1.Status{Code: code}
+		}
+		return ev
+	}
+	list := &v1beta1.EventList{
+		Items: []v1beta1.Event{
+			event("d", "abc", t0.Add(3*time.Minute), "prod", "get", "carol", "dev", 0),
+			event("c", "def", t0.Add(2*time.Minute), "prod", "delete", "alice", "dev", 200),
+			event("b", "abc", t0.Add(time.Minute), "staging", "update", "bob", "ops", 409),
+			event("a", "abc", t0, "prod", "create", "alice", "dev", 201),
+		},
+	}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := func(d time.Duration) string {
+		return url.QueryEscape(t0.Add(d).Format(time.RFC3339Nano))
+	}
+	tests := []struct {
+		query    string
+		status   int
+		expected []string
+	}{
+		{"", http.StatusOK, []string{"a", "b", "c", "d"}},
+		{"value=abc", http.StatusOK, []string{"a", "b", "d"}},
+		{"value=abc&namespace=prod", http.StatusOK, []string{"a", "d"}},
+		{"namespace=prod&resource=deployments&name=foo", http.StatusOK, []string{"a", "c", "d"}},
+		{"name=bar", http.StatusOK, []string{}},
+		{"verb=update", http.StatusOK, []string{"b"}},
+		{"user=alice", http.StatusOK, []string{"a", "c"}},
+		{"group=ops", http.StatusOK, []string{"b"}},
+		{"code=200-299", http.StatusOK, []string{"a", "c"}},
+		{"code=409", http.StatusOK, []string{"b"}},
+		{"since=" + ts(time.Minute) + "&until=" + ts(3*time.Minute), http.StatusOK, []string{"b", "c"}},
+		{"value=abc&since=" + ts(time.Minute), http.StatusOK, []string{"b", "d"}},
+		{"value=abc&until=" + ts(time.Minute), http.StatusOK, []string{"a"}},
+		{"code=2xx", http.StatusBadRequest, nil},
+		{"code=299-200", http.StatusBadRequest, nil},
+		{"since=yesterday", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get-logs?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%q: expected status %d, got %d: %s", test.query, test.status, w.Code, w.Body)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		resp := RecordList{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		ids := []string{}
+		for _, rec := range resp.Items {
+			ids = append(ids, string(rec.Event.AuditID))
+		}
+		if len(ids) != len(test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.query, test.expected, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.expected[i] {
+				t.Errorf("%q: expected %v, got %v", test.query, test.expected, ids)
+				break
+			}
+		}
+	}
+}
+
+func TestServeLogsPagination(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	list := &v1beta1.EventList{}
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		ts := now.Add(time.Duration(i) * time.Second)
+		list.Items = append(list.Items,
+			newEvent(id, v1beta1.StageRequestReceived, ts, "abc"),
+			newEvent(id, v1beta1.StageResponseComplete, ts.Add(time.Millisecond), "abc"))
+	}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	// page returns the audit IDs of all pages of the query and the number of
+	// pages.
+	page := func(query string) ([]string, int) {
+		var ids []string
+		pages := 0
+		token := ""
+		for {
+			w := httptest.NewRecorder()
+			r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get-logs?"+query+"&continue="+token, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%q: expected status %d, got %d: %s", query, http.StatusOK, w.Code, w.Body)
+			}
+			resp := RequestList{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("%q: %v", query, err)
+			}
+			pages++
+			for _, q := range resp.Items {
+				ids = append(ids, string(q.Event.AuditID))
+			}
+			if resp.Continue == "" {
+				return ids, pages
+			}
+			token = resp.Continue
+		}
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+		pages    int
+	}{
+		{"value=abc", "aabbccddee", 1},
+		{"value=abc&limit=3", "aabbccddee", 4},
+		{"limit=5", "aabbccddee", 2},
+		{"value=abc&limit=10", "aabbccddee", 1},
+		{"value=abc&view=requests&limit=2", "abcde", 3},
+		{"view=requests&limit=1", "abcde", 5},
+	}
+	for _, test := range tests {
+		ids, pages := page(test.query)
+		if strings.Join(ids, "") != test.expected || pages != test.pages {
+			t.Errorf("%q: expected %s in %d pages, got %v in %d pages", test.query, test.expected, test.pages, ids, pages)
+		}
+	}
+
+	for _, query := range []string{"limit=-1", "limit=ten", "continue=bogus", "continue=e30"} {
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get-logs?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package auditlog
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/NYTimes/gziphandler"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/pflag"
+	"github.com/syndtr/goleveldb/leveldb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+const (
+	AppName = "log-audit"
+
+	// DefaultCorrelationKey is the annotation used to group audit events by the
+	// commit that produced them.
+	DefaultCorrelationKey = "git-commit-hash"
+
+	shutdownTimeout = 30 * time.Second
+
+	// retryAfterSeconds is suggested to clients when the ingest queue is full.
+	retryAfterSeconds = "5"
+)
+
+// Views of /get-logs: the stored stage events, or the requests merged from
+// them.
+const (
+	ViewEvents   = "events"
+	ViewRequests = "requests"
+)
+
+// Options configures an audit log Receiver.
+type Options struct {
+	// ListenAddress is the TCP address the receiver listens on.
+	ListenAddress string
+	// DataDir is the directory holding the LevelDB store.
+	DataDir string
+	// CertFile and KeyFile enable TLS when both are set.
+	CertFile string
+	KeyFile  string
+	// CorrelationAnnotations and CorrelationLabels are the annotation and
+	// label keys events are correlated by. Each key is indexed separately.
+	CorrelationAnnotations []string
+	CorrelationLabels      []string
+
+	// IngestWorkers is the number of workers storing event batches.
+	IngestWorkers int
+	// IngestQueueSize is the number of event batches waiting to be stored
+	// before the receiver answers 429.
+	IngestQueueSize int
+	// IngestBatchSize is the maximum number of event batches committed by a
+	// single store write.
+	IngestBatchSize int
+	// IngestMaxBodyBytes is the maximum size of a request body of event
+	// batches. Larger batches are answered with 413.
+	IngestMaxBodyBytes int64
+
+	// PolicyFile is an audit.k8s.io Policy applied to received events before
+	// they are stored. It is reloaded every PolicyReloadInterval.
+	PolicyFile           string
+	PolicyReloadInterval time.Duration
+
+	// RedactionRules redact values from the bodies of events before they are
+	// stored, in addition to the data of Secrets. See redactionRule.
+	RedactionRules []string
+
+	// EncryptionConfig is a file holding the EncryptionConfig stored values
+	// are encrypted with. Values are stored in plaintext when it is empty.
+	EncryptionConfig string
+}
+
+func NewOptions() *Options {
+	return &Options{
+		ListenAddress:          ":8080",
+		DataDir:                filepath.Join("/var/lib", AppName),
+		CorrelationAnnotations: []string{DefaultCorrelationKey},
+
+		IngestWorkers:   4,
+		IngestQueueSize: 100,
+		IngestBatchSize: 16,
+
+		IngestMaxBodyBytes: 64 << 20,
+
+		PolicyReloadInterval: 10 * time.Second,
+	}
+}
+
+func (o *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.ListenAddress, "listen-address", o.ListenAddress, "Address the audit receiver listens on")
+	fs.StringVar(&o.DataDir, "data-dir", o.DataDir, "Directory where the audit database is stored")
+	fs.StringVar(&o.CertFile, "tls-cert-file", o.CertFile, "File containing the x509 certificate for HTTPS")
+	fs.StringVar(&o.KeyFile, "tls-private-key-file", o.KeyFile, "File containing the x509 private key matching --tls-cert-file")
+	fs.StringSliceVar(&o.CorrelationAnnotations, "correlation-annotations", o.CorrelationAnnotations, "Annotation keys used to correlate audit events")
+	fs.StringSliceVar(&o.CorrelationLabels, "correlation-labels", o.CorrelationLabels, "Label keys used to correlate audit events")
+	fs.IntVar(&o.IngestWorkers, "ingest-workers", o.IngestWorkers, "Number of workers storing audit event batches")
+	fs.IntVar(&o.IngestQueueSize, "ingest-queue-size", o.IngestQueueSize, "Number of audit event batches queued before the receiver answers 429")
+	fs.IntVar(&o.IngestBatchSize, "ingest-batch-size", o.IngestBatchSize, "Maximum number of audit event batches committed by a single store write")
+	fs.Int64Var(&o.IngestMaxBodyBytes, "ingest-max-body-bytes", o.IngestMaxBodyBytes, "Maximum size of a request body of audit events, larger ones are answered with 413")
+	fs.StringVar(&o.PolicyFile, "audit-policy-file", o.PolicyFile, "File containing an audit policy applied to received events before they are stored")
+	fs.DurationVar(&o.PolicyReloadInterval, "audit-policy-reload-interval", o.PolicyReloadInterval, "Interval at which --audit-policy-file is checked for changes")
+	fs.StringVar(&o.EncryptionConfig, "encryption-config", o.EncryptionConfig, "File containing the keys stored audit events are encrypted with")
+	fs.StringSliceVar(&o.RedactionRules, "redact", o.RedactionRules, "Rules redacting values from stored bodies in addition to Secret data, as <resource>[.<group>]=<path>, like deployments.apps=.spec.template.spec.containers[*].env[*].value")
+}
+
+func (o *Options) Validate() error {
+	var errs []error
+	if o.ListenAddress == "" {
+		errs = append(errs, fmt.Errorf("--listen-address must be set"))
+	}
+	if o.DataDir == "" {
+		errs = append(errs, fmt.Errorf("--data-dir must be set"))
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("--tls-cert-file and --tls-private-key-file must be set together"))
+	}
+	if len(o.CorrelationAnnotations)+len(o.CorrelationLabels) == 0 {
+		errs = append(errs, fmt.Errorf("at least one of --correlation-annotations and --correlation-labels must be set"))
+	}
+	if o.IngestWorkers < 1 {
+		errs = append(errs, fmt.Errorf("--ingest-workers must be positive"))
+	}
+	if o.IngestQueueSize < 0 {
+		errs = append(errs, fmt.Errorf("--ingest-queue-size must not be negative"))
+	}
+	if o.IngestBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("--ingest-batch-size must be positive"))
+	}
+	if o.IngestMaxBodyBytes < 1 {
+		errs = append(errs, fmt.Errorf("--ingest-max-body-bytes must be positive"))
+	}
+	if o.PolicyFile != "" && o.PolicyReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("--audit-policy-reload-interval must be positive"))
+	}
+	for _, rule := range o.RedactionRules {
+		if _, err := parseRedactionRule(rule); err != nil {
+			errs = append(errs, fmt.Errorf("--redact: %v", err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Receiver accepts audit events from the kube-apiserver webhook backend and
+// serves the stored logs back.
+type Receiver struct {
+	opts Options
+	keys []correlationKey
+
+	store    *Store
+	pipeline *pipeline
+	policy   *policyFilter
+	redactor *redactor
+	// inflight tracks background work, which stops when stop is closed.
+	inflight sync.WaitGroup
+	stop     chan struct{}
+	// shutdown is closed when the server of Run shuts down, which ends the
+	// running watches.
+	shutdown chan struct{}
+	// closeOnce guards Close, whose result is kept in closeErr.
+	closeOnce sync.Once
+	closeErr  error
+
+	handler *http.ServeMux
+}
+
+func NewReceiver(opts Options) *Receiver {
+	r := &Receiver{
+		opts:     opts,
+		keys:     opts.correlationKeys(),
+		stop:     make(chan struct{}),
+		shutdown: make(chan struct{}),
+		handler:  http.NewServeMux(),
+	}
+	r.handler.HandleFunc("/events", r.serveEvents)
+	r.handler.Handle("/get-logs", gziphandler.GzipHandler(http.HandlerFunc(r.serveLogs)))
+	r.handler.HandleFunc("/watch-logs", r.serveWatch)
+	r.handler.Handle("/metrics", prometheus.Handler())
+	return r
+}
+
+// Handler returns the http.Handler serving the receiver endpoints.
+func (r *Receiver) Handler() http.Handler {
+	return r.handler
+}
+
+// Open loads the audit policy, redaction rules and encryption keys and opens
+// the underlying store. It is called by Run, but can be used directly when the
+// Handler is embedded in another server. Background work is only started once
+// every step succeeded, so a failed Open leaves nothing running.
+func (r *Receiver) Open() error {
+	redactor, err := newRedactor(r.opts.RedactionRules)
+	if err != nil {
+		return err
+	}
+	r.redactor = redactor
+
+	if r.opts.PolicyFile != "" {
+		if r.policy, err = newPolicyFilter(r.opts.PolicyFile); err != nil {
+			return err
+		}
+	}
+
+	var transformer value.Transformer
+	if r.opts.EncryptionConfig != "" {
+		if transformer, err = LoadEncryptionConfig(r.opts.EncryptionConfig); err != nil {
+			return err
+		}
+	}
+	store, err := OpenStore(r.opts.DataDir, transformer)
+	if err != nil {
+		return err
+	}
+	version, err := store.SchemaVersion()
+	if err != nil {
+		store.Close()
+		return err
+	}
+	r.store = store
+	r.pipeline = newPipeline(r, r.opts.IngestWorkers, r.opts.IngestQueueSize, r.opts.IngestBatchSize)
+
+	if r.policy != nil {
+		r.inflight.Add(1)
+		go func() {
+			defer r.inflight.Done()
+			r.policy.run(r.opts.PolicyReloadInterval, r.stop)
+		}()
+	}
+	if version < SchemaVersion || transformer != nil {
+		r.inflight.Add(1)
+		go func() {
+			defer r.inflight.Done()
+			if version < SchemaVersion {
+				r.migrate()
+			}
+			if transformer != nil {
+				r.reencrypt()
+			}
+		}()
+	}
+	return nil
+}
+
+// reencrypt rewrites the values not encrypted with the current key while
+// events are being received. It stops with the receiver, and resumes on its
+// next start.
+func (r *Receiver) reencrypt() {
+	n, err := r.store.Reencrypt(r.stop)
+	if err != nil {
+		glog.Errorf("Failed to re-encrypt audit store: %v", err)
+		return
+	}
+	if n > 0 {
+		glog.Infof("Re-encrypted %d values of the audit store with the current key", n)
+	}
+}
+
+// migrate upgrades a store written by an older receiver while events are
+// being received. It stops with the receiver, and resumes on its next start.
+func (r *Receiver) migrate() {
+	res, err := Migrate(r.store, MigrateOptions{RedactionRules: r.opts.RedactionRules, Stop: r.stop})
+	if err == ErrMigrationStopped {
+		glog.Infof("Stopped migrating audit store at schema version %d of %d", res.ToVersion, SchemaVersion)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Failed to migrate audit store: %v", err)
+		return
+	}
+	glog.Infof("Migrated audit store from schema version %d to %d: %d commits, %d legacy events, %d records, %d duplicates removed",
+		res.FromVersion, res.ToVersion, res.Commits, res.LegacyEvents, res.Records, res.Duplicates)
+}
+
+// Close waits for background work to finish and closes the store. Calls after
+// the first return its result.
+func (r *Receiver) Close() error {
+	r.closeOnce.Do(func() {
+		if r.pipeline != nil {
+			r.pipeline.stop()
+		}
+		close(r.stop)
+		r.inflight.Wait()
+		if r.store != nil {
+			r.closeErr = r.store.Close()
+		}
+	})
+	return r.closeErr
+}
+
+// Run opens the store and serves the receiver endpoints until stopCh is closed.
+func (r *Receiver) Run(stopCh <-chan struct{}) error {
+	if err := r.Open(); err != nil {
+		return err
+	}
+	defer r.Close()
+
+	srv := &http.Server{
+		Addr:    r.opts.ListenAddress,
+		Handler: r.handler,
+	}
+	srv.RegisterOnShutdown(func() { close(r.shutdown) })
+	errCh := make(chan error, 1)
+	go func() {
+		glog.Infof("Serving audit receiver on %s", srv.Addr)
+		if r.opts.CertFile != "" {
+			errCh <- srv.ListenAndServeTLS(r.opts.CertFile, r.opts.KeyFile)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-stopCh:
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}
+}
+
+func (r *Receiver) serveEvents(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/events" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("method %s not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// A slot of the ingest queue is reserved before the body is read, so that
+	// a burst of batches is answered with 429 instead of being held in memory.
+	if !r.reserveIngestSlot(w) {
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, r.opts.IngestMaxBodyBytes))
+	if err != nil {
+		r.pipeline.release()
+		if _, ok := err.(*http.MaxBytesError); ok {
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", r.opts.IngestMaxBodyBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	eventList, err := decodeEventList(body, req.Header.Get("Content-Type"))
+	if err != nil {
+		r.pipeline.release()
+		if _, ok := err.(errUnsupportedMediaType); ok {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		http.Error(w, fmt.Sprintf("malformed event list: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// The webhook backend retries batches answered with an error status, so
+	// events are acknowledged only once they are committed to the store.
+	switch err := r.pipeline.submit(eventList); err {
+	case nil:
+	case ErrQueueFull:
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case ErrPipelineStopped:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		glog.Errorf("Failed to store %d audit events: %v", len(eventList.Items), err)
+		http.Error(w, fmt.Sprintf("failed to store events: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// reserveIngestSlot reserves a slot of the ingest queue for a batch, or
+// answers that there is none.
+func (r *Receiver) reserveIngestSlot(w http.ResponseWriter) bool {
+	switch err := r.pipeline.reserve(); err {
+	case nil:
+		return true
+	case ErrQueueFull:
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+	return false
+}
+
+// serveLogs streams the records correlated by a key, ordered by stage
+// timestamp, filtered by the query parameters and paged, see parseQuery. The
+// key is chosen with the annotation or label query parameter and defaults to
+// the first configured key. With view=requests, the stages of each request
+// are merged into one record.
+func (r *Receiver) serveLogs(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/get-logs" {
+		http.NotFound(w, req)
+		return
+	}
+
+	params := req.URL.Query()
+	var key correlationKey
+	if len(r.keys) > 0 {
+		key = r.keys[0]
+	}
+	q, err := parseQuery(params, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var scan func(db leveldb.Reader, fn func(id string, item interface{}) error) error
+	switch view := params.Get("view"); view {
+	case "", ViewEvents:
+		scan = func(db leveldb.Reader, fn func(id string, item interface{}) error) error {
+			return q.scan(db, func(id string, rec *Record) error {
+				return fn(id, rec)
+			})
+		}
+	case ViewRequests:
+		scan = func(db leveldb.Reader, fn func(id string, item interface{}) error) error {
+			return q.scanRequests(db, func(id string, rq *Request) error {
+				return fn(id, rq)
+			})
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown view %q, expected %q or %q", view, ViewEvents, ViewRequests), http.StatusBadRequest)
+		return
+	}
+
+	// The results are read a chunk at a time and written once the store view
+	// is released, so that a slow client does not hold a store snapshot.
+	p := &pager{limit: q.Limit}
+	list := newListWriter(w)
+	for {
+		var items []interface{}
+		err := r.store.View(func(db leveldb.Reader) error {
+			return scan(db, func(id string, item interface{}) error {
+				if len(items) == listChunkSize {
+					return errChunkFull
+				}
+				if err := p.add(id); err != nil {
+					return err
+				}
+				items = append(items, item)
+				return nil
+			})
+		})
+		if err != nil && err != errPageFull && err != errChunkFull {
+			glog.Errorf("Failed to serve %s: %v", req.URL, err)
+			list.fail(err)
+			return
+		}
+		for _, item := range items {
+			if err := list.add(item); err != nil {
+				glog.Errorf("Failed to serve %s: %v", req.URL, err)
+				return
+			}
+		}
+		if err != errChunkFull {
+			break
+		}
+		q.after = p.last
+	}
+	if err := list.close(metav1.ListMeta{Continue: p.continueToken()}); err != nil {
+		glog.Errorf("Failed to serve %s: %v", req.URL, err)
+	}
+}
+
+// QueueDepth returns the number of event batches waiting to be stored.
+func (r *Receiver) QueueDepth() int {
+	if r.pipeline == nil {
+		return 0
+	}
+	return r.pipeline.depth()
+}
+
+// ProcessEvents stores the events of list that match a correlation key,
+// bypassing the ingest queue.
+func (r *Receiver) ProcessEvents(list *v1beta1.EventList) error {
+	events, err := r.extract(list)
+	if err != nil {
+		return err
+	}
+	return r.storeEvents(events)
+}
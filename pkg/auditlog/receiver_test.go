@@ -0,0 +1,258 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func newTestReceiver(t *testing.T) (*Receiver, func()) {
+	dir := tempDir(t)
+	opts := NewOptions()
+	opts.DataDir = dir
+	r := NewReceiver(*opts)
+	if err := r.Open(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return r, func() {
+		r.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func commit(hash string) Correlation {
+	return Correlation{Source: SourceAnnotation, Key: DefaultCorrelationKey, Value: hash}
+}
+
+func newEvent(auditID string, stage v1beta1.Stage, ts time.Time, hash string) v1beta1.Event {
+	if hash == "" {
+		return newObjectEvent(auditID, stage, ts, "")
+	}
+	return newObjectEvent(auditID, stage, ts,
+		fmt.Sprintf(`{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"foo","annotations":{%q:%q}}}`, DefaultCorrelationKey, hash))
+}
+
+func newObjectEvent(auditID string, stage v1beta1.Stage, ts time.Time, response string) v1beta1.Event {
+	ev := v1beta1.Event{
+		AuditID:        types.UID(auditID),
+		Stage:          stage,
+		Verb:           "create",
+		StageTimestamp: metav1.NewMicroTime(ts),
+	}
+	if response != "" {
+		ev.ResponseObject = &runtime.Unknown{Raw: []byte(response)}
+	}
+	return ev
+}
+
+func TestProcessEventsStoresByCommit(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	list := &v1beta1.EventList{
+		Items: []v1beta1.Event{
+			newEvent("b", v1beta1.StageResponseComplete, now.Add(time.Second), "abc"),
+			newEvent("a", v1beta1.StageResponseComplete, now, "abc"),
+			newEvent("c", v1beta1.StageResponseComplete, now, "def"),
+			newEvent("d", v1beta1.StageResponseComplete, now, ""),
+		},
+	}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Event.AuditID != "a" || events[1].Event.AuditID != "b" {
+		t.Errorf("expected events a and b in order, got %+v", events)
+	}
+	events, err = storedRecords(r.store, commit("def"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event.AuditID != "c" {
+		t.Errorf("expected event c, got %+v", events)
+	}
+}
+
+func TestServeEventsStatus(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	list := &v1beta1.EventList{
+		Items: []v1beta1.Event{newEvent("a", v1beta1.StageResponseComplete, time.Now(), "abc")},
+	}
+	valid, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		body   string
+		code   int
+	}{
+		{"valid", http.MethodPost, string(valid), http.StatusOK},
+		{"malformed", http.MethodPost, "{", http.StatusBadRequest},
+		{"wrong method", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"too large", http.MethodPost, string(valid) + " ", http.StatusRequestEntityTooLarge},
+	}
+	r.opts.IngestMaxBodyBytes = int64(len(valid))
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest(c.method, "/events", strings.NewReader(c.body)))
+		if w.Code != c.code {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.code, w.Code)
+		}
+	}
+
+	// acknowledged events are already stored
+	events, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("expected 1 stored event, got %d", len(events))
+	}
+
+	r.store.Close()
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/events", bytes.NewReader(valid)))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d on storage failure, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestProcessEventsDeduplicatesRetries(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	list := &v1beta1.EventList{
+		Items: []v1beta1.Event{
+			newEvent("a", v1beta1.StageRequestReceived, now, "abc"),
+			newEvent("a", v1beta1.StageResponseComplete, now, "abc"),
+			newEvent("a", v1beta1.StageResponseComplete, now, "abc"),
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.ProcessEvents(list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a replay carrying a different stage timestamp is still the same event
+	replay := &v1beta1.EventList{
+		Items: []v1beta1.Event{newEvent("a", v1beta1.StageResponseComplete, now.Add(time.Second), "abc")},
+	}
+	if err := r.ProcessEvents(replay); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("expected one event per stage, got %d", len(events))
+	}
+}
+
+func TestReceiverLifecycle(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(policyFile, []byte("apiVersion: audit.k8s.io/v1beta1\nkind: Policy\nrules:\n- level: Metadata\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed Open starts no background work and leaves the store closed
+	opts := NewOptions()
+	opts.DataDir = filepath.Join(dir, "data")
+	opts.PolicyFile = policyFile
+	opts.EncryptionConfig = filepath.Join(dir, "missing.yaml")
+	r := NewReceiver(*opts)
+	if err := r.Open(); err == nil {
+		t.Fatal("expected an error for a missing encryption config")
+	}
+	if r.store != nil {
+		t.Errorf("expected no store after a failed Open")
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("expected Close after a failed Open to succeed, got %v", err)
+	}
+
+	// Close can be called more than once
+	opts.EncryptionConfig = ""
+	r = NewReceiver(*opts)
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.Close(); err != nil {
+			t.Errorf("close %d: %v", i, err)
+		}
+	}
+}
+
+func TestCorrelationKeys(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+	r.opts.CorrelationLabels = []string{"release"}
+	r.keys = r.opts.correlationKeys()
+
+	now := time.Now()
+	list := &v1beta1.EventList{
+		Items: []v1beta1.Event{
+			newObjectEvent("a", v1beta1.StageResponseComplete, now,
+				`{"metadata":{"name":"foo","annotations":{"git-commit-hash":"abc"},"labels":{"release":"r1"}}}`),
+			newObjectEvent("b", v1beta1.StageResponseComplete, now,
+				`{"metadata":{"name":"bar","labels":{"release":"r1"}}}`),
+		},
+	}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Correlations) != 2 {
+		t.Errorf("expected one record matching both keys, got %+v", records)
+	}
+	records, err = storedRecords(r.store, Correlation{Source: SourceLabel, Key: "release", Value: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Errorf("expected two records for the release label, got %d", len(records))
+	}
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get-logs?label=release&value=r1", nil))
+	resp := RecordList{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 2 {
+		t.Errorf("expected two records for r1, got %+v", resp)
+	}
+}
@@ -0,0 +1,259 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// redactedValue replaces redacted values in stored bodies.
+const redactedValue = "REDACTED"
+
+// secretRedactionRules are always applied. The last applied configuration
+// of kubectl holds a copy of the whole Secret.
+var secretRedactionRules = []string{
+	"secrets=.data",
+	"secrets=.stringData",
+	"secrets=.metadata.annotations['kubectl.kubernetes.io/last-applied-configuration']",
+}
+
+// redactionRule redacts the values at a path in the bodies of events on a
+// resource. It is written as <resource>[.<group>]=<path>, like
+// deployments.apps=.spec.template.spec.containers[*].env[*].value.
+type redactionRule struct {
+	resource schema.GroupResource
+	// path holds the object keys and array indices leading to the redacted
+	// value, where "*" matches any key or index.
+	path []string
+}
+
+func parseRedactionRule(s string) (redactionRule, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return redactionRule{}, fmt.Errorf("invalid redaction rule %q, expected <resource>[.<group>]=<path>", s)
+	}
+	path, err := parseRedactionPath(s[i+1:])
+	if err != nil {
+		return redactionRule{}, fmt.Errorf("invalid redaction rule %q: %v", s, err)
+	}
+	return redactionRule{resource: schema.ParseGroupResource(s[:i]), path: path}, nil
+}
+
+// parseRedactionPath parses a JSONPath of fields, quoted keys and array
+// indices, like .metadata.annotations['example.com/key'] or .items[*].
+func parseRedactionPath(s string) ([]string, error) {
+	var path []string
+	for s != "" {
+		switch {
+		case s[0] == '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty field name")
+			}
+			path, s = append(path, s[1:end+1]), s[end+1:]
+		case strings.HasPrefix(s, "['"):
+			end := strings.Index(s[2:], "']")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated key %s", s)
+			}
+			path, s = append(path, s[2:end+2]), s[end+4:]
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index %s", s)
+			}
+			index := s[1:end]
+			if _, err := strconv.Atoi(index); err != nil && index != "*" {
+				return nil, fmt.Errorf("invalid index %s", index)
+			}
+			path, s = append(path, index), s[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %s", s)
+		}
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return path, nil
+}
+
+// redactor applies redaction rules to records before they are stored.
+type redactor struct {
+	rules []redactionRule
+}
+
+// newRedactor returns a redactor applying the built-in Secret rules and rules.
+func newRedactor(rules []string) (*redactor, error) {
+	r := &redactor{}
+	for _, s := range append(append([]string(nil), secretRedactionRules...), rules...) {
+		rule, err := parseRedactionRule(s)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// redact redacts the bodies of rec and marks it as redacted if any value was
+// redacted. Opaque bodies of resources with rules are dropped, as they cannot
+// be redacted.
+func (r *redactor) redact(rec *Record) {
+	ref := rec.Event.ObjectRef
+	if ref == nil {
+		return
+	}
+	var paths [][]string
+	for _, rule := range r.rules {
+		if rule.resource.Group == ref.APIGroup && rule.resource.Resource == ref.Resource {
+			paths = append(paths, rule.path)
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	if rec.OpaqueRequestObject != nil || rec.OpaqueResponseObject != nil {
+		rec.OpaqueRequestObject, rec.OpaqueResponseObject = nil, nil
+		rec.Redacted = true
+	}
+	for _, obj := range []**runtime.Unknown{&rec.Event.RequestObject, &rec.Event.ResponseObject} {
+		if *obj == nil {
+			continue
+		}
+		raw, redacted, err := redactBody((*obj).Raw, paths)
+		if err != nil {
+			*obj = nil
+			rec.Redacted = true
+		} else if redacted {
+			*obj = &runtime.Unknown{Raw: raw, ContentType: runtime.ContentTypeJSON}
+			rec.Redacted = true
+		}
+	}
+}
+
+// redactBody redacts the values at paths in a JSON body, which may be an
+// object, a list of objects or a JSON patch.
+func redactBody(raw []byte, paths [][]string) ([]byte, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, false, err
+	}
+
+	redacted := false
+	switch b := body.(type) {
+	case map[string]interface{}:
+		list := isListBody(raw)
+		for _, path := range paths {
+			if list {
+				path = append([]string{"items", "*"}, path...)
+			}
+			if _, ok := redactPath(b, path); ok {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for _, op := range b {
+			if op, ok := op.(map[string]interface{}); ok && redactPatchOp(op, paths) {
+				redacted = true
+			}
+		}
+	}
+	if !redacted {
+		return raw, false, nil
+	}
+	data, err := json.Marshal(body)
+	return data, true, err
+}
+
+// redactPatchOp redacts the value of a JSON patch operation that sets a value
+// at or above one of paths.
+func redactPatchOp(op map[string]interface{}, paths [][]string) bool {
+	value, ok := op["value"]
+	pointer, _ := op["path"].(string)
+	if !ok || (pointer != "" && !strings.HasPrefix(pointer, "/")) {
+		return false
+	}
+	// the empty pointer is the whole document, which has no tokens
+	var tokens []string
+	if pointer != "" {
+		tokens = strings.Split(pointer[1:], "/")
+	}
+	for i := range tokens {
+		tokens[i] = unescapeJSONPointer(tokens[i])
+	}
+
+	redacted := false
+next:
+	for _, path := range paths {
+		for i, token := range tokens {
+			if i == len(path) {
+				// the operation sets a value inside the redacted one
+				value, redacted = redactedValue, true
+				continue next
+			}
+			if path[i] != "*" && path[i] != token {
+				continue next
+			}
+		}
+		if v, ok := redactPath(value, path[len(tokens):]); ok {
+			value, redacted = v, true
+		}
+	}
+	op["value"] = value
+	return redacted
+}
+
+// redactPath redacts the values at path in v, and returns v with them
+// redacted and whether any was found.
+func redactPath(v interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return redactValue(v)
+	}
+	redacted := false
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if path[0] == "*" || path[0] == k {
+				if nv, ok := redactPath(child, path[1:]); ok {
+					t[k], redacted = nv, true
+				}
+			}
+		}
+	case []interface{}:
+		for i, child := range t {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				if nv, ok := redactPath(child, path[1:]); ok {
+					t[i], redacted = nv, true
+				}
+			}
+		}
+	}
+	return v, redacted
+}
+
+// redactValue replaces a value with redactedValue. The keys of objects, like
+// the keys of Secret data, are kept.
+func redactValue(v interface{}) (interface{}, bool) {
+	switch t := v.(type) {
+	case nil:
+		return nil, false
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = redactedValue
+		}
+		return t, len(t) > 0
+	default:
+		return redactedValue, true
+	}
+}
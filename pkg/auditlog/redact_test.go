@@ -0,0 +1,125 @@
+package auditlog
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestRedactBody(t *testing.T) {
+	envRule := "deployments.apps=.spec.template.spec.containers[*].env[*].value"
+	tokenRule := "ipallowlists.example.com=.spec.token"
+	cases := []struct {
+		name     string
+		resource string
+		group    string
+		body     string
+		expected string
+	}{
+		{
+			name:     "secret",
+			resource: "secrets",
+			body:     `{"kind":"Secret","metadata":{"name":"foo","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{}","a":"1"}},"data":{"password":"c2VjcmV0"},"stringData":{"token":"secret"}}`,
+			expected: `{"data":{"password":"REDACTED"},"kind":"Secret","metadata":{"annotations":{"a":"1","kubectl.kubernetes.io/last-applied-configuration":"REDACTED"},"name":"foo"},"stringData":{"token":"REDACTED"}}`,
+		},
+		{
+			name:     "secret list",
+			resource: "secrets",
+			body:     `{"kind":"SecretList","items":[{"metadata":{"name":"foo"},"data":{"a":"YQ=="}},{"metadata":{"name":"bar"}}]}`,
+			expected: `{"items":[{"data":{"a":"REDACTED"},"metadata":{"name":"foo"}},{"metadata":{"name":"bar"}}],"kind":"SecretList"}`,
+		},
+		{
+			name:     "secret json patch",
+			resource: "secrets",
+			body:     `[{"op":"replace","path":"/data/password","value":"c2VjcmV0"},{"op":"add","path":"/metadata","value":{"labels":{"a":"1"}}},{"op":"remove","path":"/data/token"}]`,
+			expected: `[{"op":"replace","path":"/data/password","value":"REDACTED"},{"op":"add","path":"/metadata","value":{"labels":{"a":"1"}}},{"op":"remove","path":"/data/token"}]`,
+		},
+		{
+			name:     "secret json patch of the whole object",
+			resource: "secrets",
+			body:     `[{"op":"replace","path":"","value":{"kind":"Secret","data":{"password":"c2VjcmV0"}}}]`,
+			expected: `[{"op":"replace","path":"","value":{"data":{"password":"REDACTED"},"kind":"Secret"}}]`,
+		},
+		{
+			name:     "deployment env",
+			resource: "deployments",
+			group:    "apps",
+			body:     `{"kind":"Deployment","spec":{"replicas":3,"template":{"spec":{"containers":[{"name":"app","env":[{"name":"A","value":"secret"},{"name":"B","valueFrom":{}}]}]}}}}`,
+			expected: `{"kind":"Deployment","spec":{"replicas":3,"template":{"spec":{"containers":[{"env":[{"name":"A","value":"REDACTED"},{"name":"B","valueFrom":{}}],"name":"app"}]}}}}`,
+		},
+		{
+			name:     "deployment without env",
+			resource: "deployments",
+			group:    "apps",
+			body:     `{"kind":"Deployment","spec":{"replicas":3}}`,
+		},
+		{
+			name:     "object kind ending in List",
+			resource: "ipallowlists",
+			group:    "example.com",
+			body:     `{"kind":"IPAllowList","metadata":{"name":"foo"},"spec":{"token":"secret"},"items":[]}`,
+			expected: `{"items":[],"kind":"IPAllowList","metadata":{"name":"foo"},"spec":{"token":"REDACTED"}}`,
+		},
+		{
+			name:     "configmap",
+			resource: "configmaps",
+			body:     `{"kind":"ConfigMap","data":{"a":"1"}}`,
+		},
+	}
+
+	r, err := newRedactor([]string{envRule, tokenRule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		rec := &Record{Event: v1beta1.Event{
+			ObjectRef:      &v1beta1.ObjectReference{Resource: c.resource, APIGroup: c.group},
+			ResponseObject: &runtime.Unknown{Raw: []byte(c.body)},
+		}}
+		r.redact(rec)
+
+		expected := c.expected
+		if expected == "" {
+			expected = c.body
+		}
+		if got := string(rec.Event.ResponseObject.Raw); got != expected {
+			t.Errorf("%s: expected %s, got %s", c.name, expected, got)
+		}
+		if rec.Redacted != (c.expected != "") {
+			t.Errorf("%s: expected redacted %v, got %v", c.name, c.expected != "", rec.Redacted)
+		}
+	}
+
+	for _, rule := range []string{"secrets", "=.data", "secrets=data", "secrets=.data[x]", "secrets=.a['b", "secrets=[']"} {
+		if _, err := parseRedactionRule(rule); err == nil {
+			t.Errorf("expected an error for rule %q", rule)
+		}
+	}
+}
+
+func TestProcessEventsRedactsSecrets(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	ev := newObjectEvent("a", v1beta1.StageResponseComplete, time.Now(),
+		`{"kind":"Secret","apiVersion":"v1","metadata":{"name":"foo","annotations":{"git-commit-hash":"abc"}},"data":{"password":"c2VjcmV0"}}`)
+	ev.ObjectRef = &v1beta1.ObjectReference{Resource: "secrets", Namespace: "prod", Name: "foo"}
+	ev.RequestObject = &runtime.Unknown{Raw: []byte("k8s\x00garbled"), ContentType: "application/vnd.kubernetes.protobuf"}
+	if err := r.ProcessEvents(&v1beta1.EventList{Items: []v1beta1.Event{ev}}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := storedRecords(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %+v", records)
+	}
+	rec := records[0]
+	if !rec.Redacted || rec.OpaqueRequestObject != nil || string(rec.Event.ResponseObject.Raw) != `{"apiVersion":"v1","data":{"password":"REDACTED"},"kind":"Secret","metadata":{"annotations":{"git-commit-hash":"abc"},"name":"foo"}}` {
+		t.Errorf("expected a redacted record, got %+v", rec)
+	}
+}
@@ -0,0 +1,115 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+// Request is the merged record of the stored stages of an API request, which
+// share its audit ID.
+type Request struct {
+	// Record is the last stage of the request, completed with the bodies and
+	// correlations of the earlier stages.
+	Record `json:",inline"`
+
+	// Stages are the stored stages of the request, in time order.
+	Stages []StageTimestamp `json:"stages"`
+	// Latency is the time from the receipt of the request to its last stored
+	// stage.
+	Latency metav1.Duration `json:"latency"`
+}
+
+// StageTimestamp is the time an API request reached a stage.
+type StageTimestamp struct {
+	Stage     v1beta1.Stage    `json:"stage"`
+	Timestamp metav1.MicroTime `json:"timestamp"`
+}
+
+// RequestList is a list of requests, as served by /get-logs with
+// view=requests. Its metadata holds the continue token of the next page.
+type RequestList struct {
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Request `json:"items"`
+}
+
+// merge adds the stage of rec to q. Stages already merged are skipped, so
+// merging a record again leaves q unchanged.
+func (q *Request) merge(rec *Record) {
+	for _, s := range q.Stages {
+		if s.Stage == rec.Event.Stage {
+			return
+		}
+	}
+	first := len(q.Stages) == 0
+	q.Stages = append(q.Stages, StageTimestamp{Stage: rec.Event.Stage, Timestamp: rec.Event.StageTimestamp})
+	sort.SliceStable(q.Stages, func(i, j int) bool {
+		return q.Stages[i].Timestamp.Before(&q.Stages[j].Timestamp)
+	})
+
+	earlier, later := q.Record, *rec
+	if !first && rec.Event.StageTimestamp.Before(&q.Event.StageTimestamp) {
+		earlier, later = *rec, q.Record
+	}
+	merged := later
+	if merged.Event.RequestObject == nil && merged.OpaqueRequestObject == nil {
+		merged.Event.RequestObject, merged.OpaqueRequestObject = earlier.Event.RequestObject, earlier.OpaqueRequestObject
+	}
+	if merged.Event.ResponseObject == nil && merged.OpaqueResponseObject == nil {
+		merged.Event.ResponseObject, merged.OpaqueResponseObject = earlier.Event.ResponseObject, earlier.OpaqueResponseObject
+	}
+	if merged.Event.ResponseStatus == nil {
+		merged.Event.ResponseStatus = earlier.Event.ResponseStatus
+	}
+	if merged.Items == nil {
+		merged.Items = earlier.Items
+	}
+	merged.Correlations = mergeCorrelations(append([]Correlation(nil), later.Correlations...), earlier.Correlations)
+	merged.Indirect = later.Indirect && (first || earlier.Indirect)
+	merged.Redacted = later.Redacted || earlier.Redacted
+	q.Record = merged
+
+	q.Latency = metav1.Duration{}
+	if received := q.Event.RequestReceivedTimestamp; !received.IsZero() {
+		q.Latency.Duration = q.Stages[len(q.Stages)-1].Timestamp.Sub(received.Time)
+	}
+}
+
+// mergeRequest adds the stage of rec to the request record of its audit ID.
+func (t *writeTxn) mergeRequest(rec *Record) error {
+	key := requestKey(rec.Event.AuditID)
+	q := &Request{}
+	data, err := t.get(key)
+	if err == nil {
+		if err := json.Unmarshal(data, q); err != nil {
+			return fmt.Errorf("failed to unmarshal request %s: %v", key, err)
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	q.merge(rec)
+	if data, err = json.Marshal(q); err != nil {
+		return err
+	}
+	t.put(key, data)
+	return nil
+}
+
+// getRequest returns the request stored under a request key.
+func getRequest(r leveldb.Reader, key []byte) (*Request, error) {
+	data, err := r.Get(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", key, err)
+	}
+	q := &Request{}
+	if err := json.Unmarshal(data, q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal request %s: %v", key, err)
+	}
+	return q, nil
+}
@@ -0,0 +1,79 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestMergeRequestStages(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	stage := func(stage v1beta1.Stage, ts time.Time) v1beta1.Event {
+		ev := newEvent("a", stage, ts, "abc")
+		ev.RequestReceivedTimestamp = metav1.NewMicroTime(now)
+		ev.ResponseObject = nil
+		return ev
+	}
+	received := stage(v1beta1.StageRequestReceived, now)
+	received.RequestObject = &runtime.Unknown{Raw: []byte(`{"kind":"Deployment","metadata":{"name":"foo","annotations":{"git-commit-hash":"abc"}}}`)}
+	complete := stage(v1beta1.StageResponseComplete, now.Add(250*time.Millisecond))
+	complete.ResponseObject = &runtime.Unknown{Raw: []byte(`{"kind":"Deployment","metadata":{"name":"foo","annotations":{"git-commit-hash":"abc"}}}`)}
+	complete.ResponseStatus = &metav1.Status{Code: http.StatusCreated}
+
+	// the stages arrive out of order and retried
+	for _, evs := range [][]v1beta1.Event{{complete}, {received, complete}} {
+		if err := r.ProcessEvents(&v1beta1.EventList{Items: evs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests, err := storedRequests(r.store, commit("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %+v", requests)
+	}
+	q := requests[0]
+	if len(q.Stages) != 2 || q.Stages[0].Stage != v1beta1.StageRequestReceived || q.Stages[1].Stage != v1beta1.StageResponseComplete {
+		t.Errorf("expected RequestReceived and ResponseComplete stages, got %+v", q.Stages)
+	}
+	if q.Event.Stage != v1beta1.StageResponseComplete || q.Event.ResponseStatus == nil || q.Event.ResponseStatus.Code != http.StatusCreated {
+		t.Errorf("expected the final stage and status, got %+v", q.Event)
+	}
+	if q.Event.RequestObject == nil || q.Event.ResponseObject == nil {
+		t.Errorf("expected both bodies, got %+v", q.Event)
+	}
+	if q.Latency.Duration != 250*time.Millisecond {
+		t.Errorf("expected a latency of 250ms, got %v", q.Latency.Duration)
+	}
+
+	for view, expected := range map[string]int{"": 2, ViewRequests: 1, "bogus": 0} {
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get-logs?value=abc&view="+view, nil))
+		if expected == 0 {
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("view %q: expected status %d, got %d", view, http.StatusBadRequest, w.Code)
+			}
+			continue
+		}
+		resp := struct {
+			Items []json.RawMessage `json:"items"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("view %q: %v", view, err)
+		}
+		if len(resp.Items) != expected {
+			t.Errorf("view %q: expected %d records, got %d", view, expected, len(resp.Items))
+		}
+	}
+}
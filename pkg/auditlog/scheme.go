@@ -0,0 +1,38 @@
+package auditlog
+
+import (
+	"k8s.io/apimachinery/pkg/apimachinery/announced"
+	"k8s.io/apimachinery/pkg/apimachinery/registered"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/apis/audit/install"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+var (
+	groupFactoryRegistry = make(announced.APIGroupFactoryRegistry)
+	registry             = registered.NewOrDie("")
+	Scheme               = runtime.NewScheme()
+	Codecs               = serializer.NewCodecFactory(Scheme)
+)
+
+// auditV1 is the audit.k8s.io/v1 group version of newer clusters. It is not
+// part of the vendored apiserver, but its Event is the v1beta1 Event without
+// the deprecated metadata and timestamp fields and its Policy is the v1beta1
+// Policy, so v1 payloads and policies are decoded with the v1beta1 types and
+// their conversions.
+var auditV1 = schema.GroupVersion{Group: audit.GroupName, Version: "v1"}
+
+// storageVersion is the single version events are stored and served in.
+var storageVersion = v1beta1.SchemeGroupVersion
+
+func init() {
+	install.Install(groupFactoryRegistry, registry, Scheme)
+	Scheme.AddKnownTypes(auditV1, &v1beta1.Event{}, &v1beta1.EventList{}, &v1beta1.Policy{}, &v1beta1.PolicyList{})
+
+	// we need to add the options to empty v1
+	metav1.AddToGroupVersion(Scheme, schema.GroupVersion{Version: "v1"})
+}
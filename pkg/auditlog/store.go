@@ -0,0 +1,327 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+// openDB opens the LevelDB store in dir, creating it when missing. Existing
+// data is never removed: a corrupted store is recovered from its tables, and
+// a store that is locked or can not be recovered is reported as an error.
+func openDB(dir string) (*leveldb.DB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit database directory %s: %v", dir, err)
+	}
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err == nil {
+		return db, nil
+	}
+	if !errors.IsCorrupted(err) {
+		return nil, fmt.Errorf("failed to open audit database %s, it may be locked by another process: %v", dir, err)
+	}
+
+	glog.Warningf("Audit database %s is corrupted, trying to recover it: %v", dir, err)
+	db, err = leveldb.RecoverFile(dir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover corrupted audit database %s: %v", dir, err)
+	}
+	glog.Infof("Recovered audit database %s", dir)
+	return db, nil
+}
+
+// ErrStoreClosed is returned by operations on a closed Store.
+var ErrStoreClosed = fmt.Errorf("audit store is closed")
+
+// Store is the audit database shared by all handlers of a Receiver. It is
+// opened once and is safe for concurrent use: any number of readers run in
+// parallel on consistent snapshots, while writers are serialized so that each
+// read-modify-write cycle is committed as a single batch.
+type Store struct {
+	db *leveldb.DB
+	// transformer encrypts stored values, if set. See storedValue.
+	transformer value.Transformer
+
+	// lifecycle is held for reading by every operation and for writing by
+	// Close, so the database is never closed under a running operation.
+	lifecycle sync.RWMutex
+	closed    bool
+
+	// wmu serializes writers.
+	wmu sync.Mutex
+
+	// changed is closed and replaced after every committed write, see
+	// changes.
+	cmu     sync.Mutex
+	changed chan struct{}
+}
+
+// OpenStore opens the audit store in dir, see openDB. A store without a
+// schema version marker is marked with its version, which is the current one
+// for new stores; stores written by a newer version of the receiver are
+// refused. Values are encrypted with transformer, if not nil.
+func OpenStore(dir string, transformer value.Transformer) (*Store, error) {
+	db, err := openDB(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{db: db, transformer: transformer, changed: make(chan struct{})}
+
+	version, marked, err := s.schemaVersion()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version > SchemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("audit database %s has schema version %d, this receiver supports up to %d", dir, version, SchemaVersion)
+	}
+	// Legacy stores are marked before anything is written, so that an
+	// interrupted migration of their last blob is not mistaken for a new store.
+	if !marked {
+		if err := s.setSchemaVersion(version); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// View calls fn with a consistent snapshot of the store.
+func (s *Store) View(fn func(r leveldb.Reader) error) error {
+	return s.view(func(r leveldb.Reader) error {
+		return fn(s.reader(r))
+	})
+}
+
+// view calls fn with a consistent snapshot of the values as stored.
+func (s *Store) view(fn func(r leveldb.Reader) error) error {
+	s.lifecycle.RLock()
+	defer s.lifecycle.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return fn(snap)
+}
+
+// Update calls fn with exclusive write access to the store. The reader passed
+// to fn observes every previously committed update; the writes fn records in
+// the batch are committed atomically once fn returns without error.
+func (s *Store) Update(fn func(r leveldb.Reader, b *leveldb.Batch) error) error {
+	return s.update(func(r leveldb.Reader) (*leveldb.Batch, error) {
+		b := new(leveldb.Batch)
+		if err := fn(s.reader(r), b); err != nil {
+			return nil, err
+		}
+		return s.toStorage(b)
+	})
+}
+
+// update calls fn with exclusive write access to the values as stored, and
+// commits the batch it returns.
+func (s *Store) update(fn func(r leveldb.Reader) (*leveldb.Batch, error)) error {
+	s.lifecycle.RLock()
+	defer s.lifecycle.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	b, err := fn(s.db)
+	if err != nil {
+		return err
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return s.write(b)
+}
+
+// write commits b and wakes the watchers of the store.
+func (s *Store) write(b *leveldb.Batch) error {
+	if err := s.db.Write(b, nil); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// notify wakes the watchers of the store.
+func (s *Store) notify() {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// changes returns a channel that is closed once the store is written to or
+// closed.
+func (s *Store) changes() <-chan struct{} {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	return s.changed
+}
+
+// Close waits for running operations to finish and closes the store.
+func (s *Store) Close() error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.notify()
+	return s.db.Close()
+}
+
+// storedValue reports whether the value of key is transformed in storage.
+// The store metadata and the empty values of index entries are not.
+func storedValue(key, v []byte) bool {
+	return len(v) > 0 && !bytes.HasPrefix(key, []byte(metaPrefix))
+}
+
+// reader returns r reading values through the transformer of the store.
+func (s *Store) reader(r leveldb.Reader) leveldb.Reader {
+	if s.transformer == nil {
+		return r
+	}
+	return &transformingReader{r: r, transformer: s.transformer}
+}
+
+// toStorage returns b with its values transformed for storage.
+func (s *Store) toStorage(b *leveldb.Batch) (*leveldb.Batch, error) {
+	if s.transformer == nil {
+		return b, nil
+	}
+	t := &storageBatch{transformer: s.transformer, b: new(leveldb.Batch)}
+	if err := b.Replay(t); err != nil {
+		return nil, err
+	}
+	return t.b, t.err
+}
+
+// storageBatch records the writes of a batch with transformed values.
+type storageBatch struct {
+	transformer value.Transformer
+	b           *leveldb.Batch
+	err         error
+}
+
+func (t *storageBatch) Put(key, v []byte) {
+	if t.err != nil {
+		return
+	}
+	if storedValue(key, v) {
+		// the value is bound to its key, so it can not be swapped with another
+		v, t.err = t.transformer.TransformToStorage(v, value.DefaultContext(key))
+	}
+	t.b.Put(key, v)
+}
+
+func (t *storageBatch) Delete(key []byte) {
+	t.b.Delete(key)
+}
+
+// transformingReader reads values through a transformer.
+type transformingReader struct {
+	r           leveldb.Reader
+	transformer value.Transformer
+}
+
+func (r *transformingReader) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	data, err := r.r.Get(key, ro)
+	if err != nil || !storedValue(key, data) {
+		return data, err
+	}
+	data, _, err = r.transformer.TransformFromStorage(data, value.DefaultContext(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %v", key, err)
+	}
+	return data, nil
+}
+
+func (r *transformingReader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return &transformingIterator{Iterator: r.r.NewIterator(slice, ro), transformer: r.transformer}
+}
+
+// transformingIterator transforms values when they are read. A value that
+// fails to transform is returned as nil, and stops the iteration with an
+// error.
+type transformingIterator struct {
+	iterator.Iterator
+	transformer value.Transformer
+	err         error
+}
+
+func (it *transformingIterator) Next() bool {
+	return it.err == nil && it.Iterator.Next()
+}
+
+func (it *transformingIterator) Value() []byte {
+	key, data := it.Iterator.Key(), it.Iterator.Value()
+	if !storedValue(key, data) {
+		return data
+	}
+	data, _, err := it.transformer.TransformFromStorage(data, value.DefaultContext(key))
+	if err != nil {
+		glog.Errorf("Failed to decrypt %s: %v", key, err)
+		it.err = fmt.Errorf("failed to decrypt %s: %v", key, err)
+		return nil
+	}
+	return data
+}
+
+func (it *transformingIterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.Iterator.Error()
+}
+
+// getRecord returns the record stored under an event key.
+func getRecord(r leveldb.Reader, key []byte) (*Record, error) {
+	data, err := r.Get(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", key, err)
+	}
+	rec := &Record{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal record %s: %v", key, err)
+	}
+	return rec, nil
+}
+
+// scanIndexKeys calls fn with the correlation and event key of every index
+// entry in rng, in key order.
+func scanIndexKeys(r leveldb.Reader, rng *util.Range, fn func(c Correlation, key []byte) error) error {
+	iter := r.NewIterator(rng, nil)
+	defer iter.Release()
+	for iter.Next() {
+		c, key, ok := parseIndexKey(iter.Key())
+		if !ok {
+			return fmt.Errorf("invalid index key %s", iter.Key())
+		}
+		if err := fn(c, key); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
@@ -0,0 +1,185 @@
+package auditlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", AppName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestOpenDBKeepsData(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("foo"), []byte("bar"), nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get([]byte("foo"), nil); err != nil || string(v) != "bar" {
+		t.Errorf("expected stored value to survive reopen, got %q, %v", v, err)
+	}
+}
+
+func TestOpenDBLocked(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := openDB(dir); err == nil {
+		t.Error("expected an error opening a locked database")
+	}
+}
+
+func TestOpenDBRecoversCorruption(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("foo"), []byte("bar"), nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	manifests, err := filepath.Glob(filepath.Join(dir, "MANIFEST-*"))
+	if err != nil || len(manifests) == 0 {
+		t.Fatalf("no manifest found: %v", err)
+	}
+	for _, m := range manifests {
+		if err := ioutil.WriteFile(m, []byte("garbage"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = openDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, err := db.Get([]byte("foo"), nil); err != nil || string(v) != "bar" {
+		t.Errorf("expected recovered value, got %q, %v", v, err)
+	}
+}
+
+func TestStoreConcurrentUpdates(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := s.Update(func(r leveldb.Reader, b *leveldb.Batch) error {
+				count := 0
+				if v, err := r.Get([]byte("counter"), nil); err == nil {
+					count, _ = strconv.Atoi(string(v))
+				}
+				b.Put([]byte("counter"), []byte(strconv.Itoa(count+1)))
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := s.View(func(r leveldb.Reader) error {
+				_, err := r.Get([]byte("counter"), nil)
+				if err != nil && err != leveldb.ErrNotFound {
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = s.View(func(r leveldb.Reader) error {
+		v, err := r.Get([]byte("counter"), nil)
+		if err != nil {
+			return err
+		}
+		if string(v) != strconv.Itoa(n) {
+			return fmt.Errorf("expected counter %d, got %s", n, v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.View(func(leveldb.Reader) error { return nil }); err != ErrStoreClosed {
+		t.Errorf("expected ErrStoreClosed, got %v", err)
+	}
+}
+
+// storedRecords returns the records correlated by c, ordered by stage
+// timestamp.
+func storedRecords(s *Store, c Correlation) ([]Record, error) {
+	q := &Query{Source: c.Source, Key: c.Key, Value: c.Value}
+	var records []Record
+	err := s.View(func(r leveldb.Reader) error {
+		return q.scan(r, func(_ string, rec *Record) error {
+			records = append(records, *rec)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// storedRequests returns the requests with a stage correlated by c, ordered
+// by the time of their first correlated stage.
+func storedRequests(s *Store, c Correlation) ([]Request, error) {
+	q := &Query{Source: c.Source, Key: c.Key, Value: c.Value}
+	var requests []Request
+	err := s.View(func(r leveldb.Reader) error {
+		return q.scanRequests(r, func(_ string, req *Request) error {
+			requests = append(requests, *req)
+			return nil
+		})
+	})
+	return requests, err
+}
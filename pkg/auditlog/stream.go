@@ -0,0 +1,75 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listChunkSize is the number of items of a streamed list read from the store
+// at a time, which bounds the items held in memory.
+const listChunkSize = 100
+
+// errChunkFull stops the scan of a chunk once it holds listChunkSize items.
+var errChunkFull = fmt.Errorf("chunk is full")
+
+// listWriter streams a RecordList or RequestList to a response item by item.
+// The items are written before the list metadata, which is only known once
+// the last item is.
+type listWriter struct {
+	w   http.ResponseWriter
+	enc *json.Encoder
+	// started is set once the response header and the first item are
+	// written. Errors can no longer be reported with a status code.
+	started bool
+}
+
+func newListWriter(w http.ResponseWriter) *listWriter {
+	return &listWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+// add writes item to the list.
+func (l *listWriter) add(item interface{}) error {
+	sep := ","
+	if !l.started {
+		l.w.Header().Set("Content-Type", "application/json")
+		l.started = true
+		sep = `{"items":[`
+	}
+	if _, err := l.w.Write([]byte(sep)); err != nil {
+		return err
+	}
+	return l.enc.Encode(item)
+}
+
+// close ends the list with its metadata.
+func (l *listWriter) close(meta metav1.ListMeta) error {
+	if !l.started {
+		l.w.Header().Set("Content-Type", "application/json")
+		l.started = true
+		if _, err := l.w.Write([]byte(`{"items":[`)); err != nil {
+			return err
+		}
+	}
+	if _, err := l.w.Write([]byte(`],"metadata":`)); err != nil {
+		return err
+	}
+	if err := l.enc.Encode(meta); err != nil {
+		return err
+	}
+	_, err := l.w.Write([]byte("}"))
+	return err
+}
+
+// fail reports err, as a status code if nothing was written yet. Otherwise
+// the response is aborted, so that the client sees a truncated list instead
+// of a complete one.
+func (l *listWriter) fail(err error) {
+	if !l.started {
+		http.Error(l.w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
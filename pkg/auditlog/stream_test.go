@@ -0,0 +1,86 @@
+package auditlog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestServeLogsStreaming(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+
+	now := time.Now()
+	list := &v1beta1.EventList{}
+	// more records than fit in a chunk
+	for i := 0; i < 250; i++ {
+		list.Items = append(list.Items, newEvent(fmt.Sprintf("a%03d", i), v1beta1.StageResponseComplete, now.Add(time.Duration(i)*time.Second), "abc"))
+	}
+	if err := r.ProcessEvents(list); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		gzip     bool
+		expected int
+		more     bool
+	}{
+		{"value=abc", false, 250, false},
+		{"value=abc", true, 250, false},
+		{"value=abc&limit=20", true, 20, true},
+		{"value=abc&limit=200", false, 200, true},
+		{"value=abc&limit=250", false, 250, false},
+		{"value=abc&view=requests", false, 250, false},
+		{"value=def", false, 0, false},
+		{"value=def", true, 0, false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/get-logs?"+test.query, nil)
+		if test.gzip {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: expected status %d, got %d: %s", test.query, http.StatusOK, w.Code, w.Body)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%q: expected a JSON response, got %q", test.query, ct)
+		}
+
+		// small responses are sent uncompressed
+		compressed := w.Header().Get("Content-Encoding") == "gzip"
+		if compressed != (test.gzip && test.expected > 0) {
+			t.Errorf("%q: expected gzip %v, got %v", test.query, test.gzip && test.expected > 0, compressed)
+			continue
+		}
+		dec := json.NewDecoder(w.Body)
+		if compressed {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec = json.NewDecoder(gz)
+		}
+		resp := RecordList{}
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+		if len(resp.Items) != test.expected || (resp.Continue != "") != test.more {
+			t.Errorf("%q: expected %d records and more %v, got %d records and continue %q", test.query, test.expected, test.more, len(resp.Items), resp.Continue)
+		}
+		for i := 1; i < len(resp.Items); i++ {
+			if resp.Items[i].Event.AuditID <= resp.Items[i-1].Event.AuditID {
+				t.Errorf("%q: expected records in time order, got %s after %s", test.query, resp.Items[i].Event.AuditID, resp.Items[i-1].Event.AuditID)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package auditlog
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+// Record is an audit event as stored and served by the receiver.
+type Record struct {
+	// Event is the audit event in the storage version.
+	Event v1beta1.Event `json:"event"`
+	// Correlations are the correlation keys the event matched.
+	Correlations []Correlation `json:"correlations"`
+	// Indirect is set for events attributed through the owners of their
+	// object, like the Pods of an annotated Deployment.
+	Indirect bool `json:"indirect,omitempty"`
+	// Items are the items of a list body that matched a correlation key.
+	Items []MatchedItem `json:"items,omitempty"`
+
+	// OpaqueRequestObject and OpaqueResponseObject hold the bodies of the
+	// event that could not be decoded, which are removed from Event.
+	OpaqueRequestObject  *OpaqueObject `json:"opaqueRequestObject,omitempty"`
+	OpaqueResponseObject *OpaqueObject `json:"opaqueResponseObject,omitempty"`
+
+	// Redacted is set for events with values removed from their bodies
+	// before they were stored, like the data of Secrets.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// RecordList is a list of records ordered by stage timestamp, as served by
+// /get-logs. Its metadata holds the continue token of the next page.
+type RecordList struct {
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Record `json:"items"`
+}
+
+// OpaqueObject is a request or response body kept as it was received.
+type OpaqueObject struct {
+	ContentType     string `json:"contentType,omitempty"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	Raw             []byte `json:"raw"`
+}
+
+// MatchedItem identifies an item of a list body, like the response of a list
+// or deletecollection request, and the correlations found on it.
+type MatchedItem struct {
+	Namespace    string        `json:"namespace,omitempty"`
+	Name         string        `json:"name"`
+	UID          types.UID     `json:"uid,omitempty"`
+	Correlations []Correlation `json:"correlations"`
+}
+
+// Correlation is a correlation key and the value an event carried for it.
+type Correlation struct {
+	// Source is where the key was found, "annotation" or "label".
+	Source string `json:"source"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	// From is the part of the event the correlation was found in.
+	From string `json:"from,omitempty"`
+}
+
+const (
+	SourceAnnotation = "annotation"
+	SourceLabel      = "label"
+)
+
+const (
+	FromResponseObject = "responseObject"
+	FromRequestObject  = "requestObject"
+	// FromObjectUID and FromObjectRef mark correlations of events without a
+	// correlated body, taken from the last correlated event on the object with
+	// the same UID, or else the same group, resource, namespace and name.
+	FromObjectUID = "objectUID"
+	FromObjectRef = "objectRef"
+	// FromOwnerReference marks correlations taken from the last correlated
+	// event on an owner of the object.
+	FromOwnerReference = "ownerReference"
+)
@@ -0,0 +1,169 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// watchHeartbeat is the interval of the comments sent to idle watchers, which
+// keep proxies from closing the connection and detect gone clients.
+const watchHeartbeat = 30 * time.Second
+
+// serveWatch streams the records stored from now on that match the query
+// parameters of /get-logs, as Server-Sent Events:
+//
+//	id: <resource version>
+//	data: <record>
+//
+// A client resumes after a disconnect from the last resource version it saw,
+// given by the Last-Event-ID header or the resourceVersion query parameter.
+// Events stored before the watch started are then sent first. Watches are not
+// paged, so the limit and continue parameters are rejected.
+func (r *Receiver) serveWatch(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/watch-logs" {
+		http.NotFound(w, req)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	params := req.URL.Query()
+	for _, param := range []string{"limit", "continue"} {
+		if params.Get(param) != "" {
+			http.Error(w, fmt.Sprintf("%s is not supported by watches", param), http.StatusBadRequest)
+			return
+		}
+	}
+	var key correlationKey
+	if len(r.keys) > 0 {
+		key = r.keys[0]
+	}
+	q, err := parseQuery(params, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version := req.Header.Get("Last-Event-ID")
+	if version == "" {
+		version = params.Get("resourceVersion")
+	}
+	var after uint64
+	if version != "" {
+		if after, err = strconv.ParseUint(version, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid resource version %q", version), http.StatusBadRequest)
+			return
+		}
+	} else if err := r.store.View(func(db leveldb.Reader) error {
+		after, err = lastSequence(db)
+		return err
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		// taken before the scan, so that no write is missed
+		changed := r.store.changes()
+		// the records are read a chunk at a time and written once the store
+		// view is released, so that a slow client does not hold a snapshot
+		var batch []watchedRecord
+		err := r.store.View(func(db leveldb.Reader) error {
+			var err error
+			after, err = q.watch(db, after, func(seq uint64, rec *Record) error {
+				if len(batch) == listChunkSize {
+					return errChunkFull
+				}
+				batch = append(batch, watchedRecord{seq: seq, rec: rec})
+				return nil
+			})
+			return err
+		})
+		if err != nil && err != errChunkFull {
+			if err != ErrStoreClosed {
+				glog.Errorf("Failed to serve %s: %v", req.URL, err)
+			}
+			return
+		}
+		for _, ev := range batch {
+			if err := writeWatchEvent(w, ev.seq, ev.rec); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if err == errChunkFull {
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-r.shutdown:
+			return
+		}
+	}
+}
+
+// watch calls fn with the records logged after the sequence number after
+// that match q, in the order they were stored. It returns the sequence number
+// of the last record scanned, which excludes a record fn failed on.
+func (q *Query) watch(r leveldb.Reader, after uint64, fn func(seq uint64, rec *Record) error) (uint64, error) {
+	iter := r.NewIterator(&util.Range{Start: seqKey(after + 1), Limit: util.BytesPrefix([]byte(seqPrefix)).Limit}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		seq, ok := parseSeqKey(iter.Key())
+		if !ok {
+			return after, fmt.Errorf("invalid event log key %s", iter.Key())
+		}
+		rec, err := getRecord(r, iter.Value())
+		if err != nil {
+			return after, err
+		}
+		ts := rec.Event.StageTimestamp.Time
+		if q.selects(rec) && (q.Since.IsZero() || !ts.Before(q.Since)) && (q.Until.IsZero() || ts.Before(q.Until)) {
+			if err := fn(seq, rec); err != nil {
+				return after, err
+			}
+		}
+		after = seq
+	}
+	return after, iter.Error()
+}
+
+// watchedRecord is a record read by a watch, sent with its sequence number.
+type watchedRecord struct {
+	seq uint64
+	rec *Record
+}
+
+func writeWatchEvent(w http.ResponseWriter, seq uint64, rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", seq, data)
+	return err
+}
@@ -0,0 +1,133 @@
+package auditlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/apis/audit/v1beta1"
+)
+
+func TestServeWatch(t *testing.T) {
+	r, cleanup := newTestReceiver(t)
+	defer cleanup()
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+
+	now := time.Now()
+	store := func(id, hash string) {
+		list := &v1beta1.EventList{Items: []v1beta1.Event{newEvent(id, v1beta1.StageResponseComplete, now, hash)}}
+		if err := r.ProcessEvents(list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type watchEvent struct {
+		id      string
+		auditID string
+	}
+	// watch opens a watch and returns a function reading its next n events.
+	watch := func(query, lastEventID string) (func(n int) []watchEvent, func()) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/watch-logs?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			t.Fatalf("%q: expected status %d, got %d", query, http.StatusOK, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("%q: expected an event stream, got %q", query, ct)
+		}
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, 1<<20)
+		next := func(n int) []watchEvent {
+			var events []watchEvent
+			ev := watchEvent{}
+			for len(events) < n && scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case strings.HasPrefix(line, "id: "):
+					ev.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "data: "):
+					rec := &Record{}
+					if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), rec); err != nil {
+						t.Fatalf("%q: %v", query, err)
+					}
+					ev.auditID = string(rec.Event.AuditID)
+				case line == "" && ev.id != "":
+					events = append(events, ev)
+					ev = watchEvent{}
+				}
+			}
+			return events
+		}
+		return next, func() { resp.Body.Close() }
+	}
+	auditIDs := func(events []watchEvent) string {
+		var ids []string
+		for _, ev := range events {
+			ids = append(ids, ev.auditID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	store("a", "abc")
+
+	// a new watch only sees events stored after it started
+	next, stop := watch("value=abc", "")
+	store("b", "abc")
+	store("c", "def")
+	store("d", "abc")
+	events := next(2)
+	if ids := auditIDs(events); ids != "b,d" {
+		t.Fatalf("expected events b,d, got %s", ids)
+	}
+	stop()
+
+	// a resumed watch first sees the events it missed
+	store("e", "abc")
+	next, stop = watch("value=abc", events[0].id)
+	if ids := auditIDs(next(2)); ids != "d,e" {
+		t.Errorf("expected events d,e after resuming, got %s", ids)
+	}
+	stop()
+
+	next, stop = watch("resourceVersion=0&value=def", "")
+	if ids := auditIDs(next(1)); ids != "c" {
+		t.Errorf("expected event c from the start, got %s", ids)
+	}
+	stop()
+
+	// a watch catching up sends more records than fit in a chunk
+	for i := 0; i < 150; i++ {
+		store(fmt.Sprintf("g%03d", i), "ghi")
+	}
+	next, stop = watch("resourceVersion=0&value=ghi", "")
+	if events := next(150); len(events) != 150 || events[0].auditID != "g000" || events[149].auditID != "g149" {
+		t.Errorf("expected events g000 to g149, got %s", auditIDs(events))
+	}
+	stop()
+
+	for _, query := range []string{"resourceVersion=latest", "code=bogus", "limit=10", "continue=abc"} {
+		resp, err := http.Get(srv.URL + "/watch-logs?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cmds
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/kubepack/packserver/pkg/auditlog"
+	"github.com/spf13/cobra"
+	"k8s.io/apiserver/pkg/storage/value"
+)
+
+func NewCmdAudit(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Manage the audit log database",
+	}
+	cmd.AddCommand(NewCmdAuditMigrate(out))
+	cmd.AddCommand(NewCmdAuditKeys(out))
+	return cmd
+}
+
+// openAuditStore opens the audit database in dataDir, encrypted with the keys
+// of encryptionConfig if it is set.
+func openAuditStore(dataDir, encryptionConfig string) (*auditlog.Store, error) {
+	var transformer value.Transformer
+	if encryptionConfig != "" {
+		var err error
+		if transformer, err = auditlog.LoadEncryptionConfig(encryptionConfig); err != nil {
+			return nil, err
+		}
+	}
+	return auditlog.OpenStore(dataDir, transformer)
+}
+
+func NewCmdAuditMigrate(out io.Writer) *cobra.Command {
+	dataDir := auditlog.NewOptions().DataDir
+	var encryptionConfig string
+	var redactionRules []string
+
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate the audit database to the current schema version",
+		Long: "Migrate the audit database to the current schema version. The migration can be interrupted and run again safely. " +
+			"A running audit-receiver migrates its database on start, so this command is only needed for stopped receivers.",
+		RunE: func(c *cobra.Command, args []string) error {
+			store, err := openAuditStore(dataDir, encryptionConfig)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			res, err := auditlog.Migrate(store, auditlog.MigrateOptions{RedactionRules: redactionRules})
+			if err != nil {
+				return err
+			}
+			if res.FromVersion == res.ToVersion {
+				fmt.Fprintf(out, "Audit database is already at schema version %d\n", res.ToVersion)
+				return nil
+			}
+			fmt.Fprintf(out, "Migrated audit database from schema version %d to %d\n", res.FromVersion, res.ToVersion)
+			fmt.Fprintf(out, "Commits: %d, legacy events: %d, records: %d, duplicates removed: %d\n", res.Commits, res.LegacyEvents, res.Records, res.Duplicates)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&dataDir, "data-dir", dataDir, "Directory where the audit database is stored")
+	cmd.Flags().StringVar(&encryptionConfig, "encryption-config", encryptionConfig, "File containing the keys the audit database is encrypted with")
+	cmd.Flags().StringSliceVar(&redactionRules, "redact", redactionRules, "Redaction rules of the audit-receiver, applied to stored bodies in addition to Secret data")
+
+	return cmd
+}
+
+func NewCmdAuditKeys(out io.Writer) *cobra.Command {
+	dataDir := auditlog.NewOptions().DataDir
+	var encryptionConfig string
+	var reencrypt bool
+
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Report the encryption keys in use by the audit database",
+		Long: "Report the number of values of the audit database encrypted with each key. A key can be removed from the encryption config " +
+			"once no value uses it. A running audit-receiver re-encrypts values with the first key on start, --reencrypt does so for stopped receivers.",
+		RunE: func(c *cobra.Command, args []string) error {
+			if reencrypt && encryptionConfig == "" {
+				return fmt.Errorf("--reencrypt requires --encryption-config")
+			}
+			store, err := openAuditStore(dataDir, encryptionConfig)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			if reencrypt {
+				n, err := store.Reencrypt(nil)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "Re-encrypted %d values\n", n)
+			}
+
+			usage, err := store.KeyUsage()
+			if err != nil {
+				return err
+			}
+			names := make([]string, 0, len(usage))
+			for name := range usage {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "KEY\tVALUES")
+			for _, name := range names {
+				key := name
+				if key == "" {
+					key = "(plaintext)"
+				}
+				fmt.Fprintf(w, "%s\t%d\n", key, usage[name])
+			}
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&dataDir, "data-dir", dataDir, "Directory where the audit database is stored")
+	cmd.Flags().StringVar(&encryptionConfig, "encryption-config", encryptionConfig, "File containing the keys the audit database is encrypted with")
+	cmd.Flags().BoolVar(&reencrypt, "reencrypt", reencrypt, "Re-encrypt values not encrypted with the first key of --encryption-config before reporting")
+
+	return cmd
+}
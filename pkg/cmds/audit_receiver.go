@@ -0,0 +1,26 @@
+package cmds
+
+import (
+	"github.com/kubepack/packserver/pkg/auditlog"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdAuditReceiver(stopCh <-chan struct{}) *cobra.Command {
+	o := auditlog.NewOptions()
+
+	cmd := &cobra.Command{
+		Use:   "audit-receiver",
+		Short: "Launch the audit log receiver",
+		Long:  "Launch the audit log receiver which stores events sent by the kube-apiserver audit webhook",
+		RunE: func(c *cobra.Command, args []string) error {
+			if err := o.Validate(); err != nil {
+				return err
+			}
+			return auditlog.NewReceiver(*o).Run(stopCh)
+		},
+	}
+
+	o.AddFlags(cmd.Flags())
+
+	return cmd
+}
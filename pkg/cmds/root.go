@@ -52,6 +52,8 @@ func NewRootCmd() *cobra.Command {
 	rootCmd.AddCommand(v.NewCmdVersion())
 	stopCh := genericapiserver.SetupSignalHandler()
 	rootCmd.AddCommand(NewCmdRun(os.Stdout, os.Stderr, stopCh))
+	rootCmd.AddCommand(NewCmdAuditReceiver(stopCh))
+	rootCmd.AddCommand(NewCmdAudit(os.Stdout))
 
 	return rootCmd
 }